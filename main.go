@@ -5,11 +5,13 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/alext/tablecloth"
 	"github.com/alphagov/performance-datastore/pkg/config"
 	"github.com/alphagov/performance-datastore/pkg/handlers"
+	"github.com/alphagov/performance-datastore/pkg/validation"
 )
 
 func main() {
@@ -24,6 +26,20 @@ func main() {
 		bearerToken  = getEnvDefault("BEARER_TOKEN", "EMPTY")
 		configAPIURL = getEnvDefault("CONFIG_API_URL", "https://stagecraft.production.performance.service.gov.uk/")
 		maxGzipBody  = getEnvDefault("MAX_GZIP_SIZE", "10000000")
+		unordered    = getEnvDefault("MONGO_UNORDERED_WRITES", "false")
+		idempotency  = getEnvDefault("IDEMPOTENCY_KEY_TTL", "24h")
+		nestingDepth = getEnvDefault("MAX_NESTING_DEPTH", strconv.Itoa(validation.MaxDepth))
+		retention    = getEnvDefault("RETENTION_INTERVAL", "1h")
+		requestRate  = getEnvDefault("RATE_LIMIT_REQUESTS", "")
+		recordRate   = getEnvDefault("RATE_LIMIT_RECORDS", "")
+		dataSetReqs  = getEnvDefault("RATE_LIMIT_DATASET_REQUESTS", "")
+		dataSetRecs  = getEnvDefault("RATE_LIMIT_DATASET_RECORDS", "")
+		jobTTL       = getEnvDefault("JOB_TTL", "24h")
+		journalRetry = getEnvDefault("JOURNAL_REPLAY_INTERVAL", "10s")
+		journalDir   = getEnvDefault("JOURNAL_DIR", "")
+		jobDir       = getEnvDefault("JOB_QUEUE_DIR", "")
+		auditLog     = getEnvDefault("AUDIT_LOG", "")
+		proxies      = getEnvDefault("TRUSTED_PROXIES", "")
 		logLevel     = getEnvDefault("LOG_LEVEL", "info")
 		logger       = newLog(logLevel)
 	)
@@ -32,15 +48,112 @@ func main() {
 	wg.Add(1)
 
 	handlers.ConfigAPIClient = config.NewClient(configAPIURL, bearerToken, logger)
-	handlers.DataSetStorage = handlers.NewMongoStorage(mongoURL, databaseName)
 	handlers.StatsdClient = handlers.NewStatsDClient("localhost:8125", "datastore.")
 
+	// Every setting is read before any goroutine starts, so that none of them
+	// sees, or races with, a setting which is still to be changed
 	maxBody, err := strconv.Atoi(maxGzipBody)
 
 	if err != nil {
 		logger.Fatal(err)
 	}
 
+	unorderedWrites, err := strconv.ParseBool(unordered)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	replayInterval, err := time.ParseDuration(journalRetry)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	idempotencyTTL, err := time.ParseDuration(idempotency)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if handlers.RateLimits.Requests, err = handlers.ParseRateLimit(requestRate); err != nil {
+		logger.Fatal(err)
+	}
+
+	if handlers.RateLimits.Records, err = handlers.ParseRateLimit(recordRate); err != nil {
+		logger.Fatal(err)
+	}
+
+	if handlers.DefaultDataSetRateLimits.Requests, err = handlers.ParseRateLimit(dataSetReqs); err != nil {
+		logger.Fatal(err)
+	}
+
+	if handlers.DefaultDataSetRateLimits.Records, err = handlers.ParseRateLimit(dataSetRecs); err != nil {
+		logger.Fatal(err)
+	}
+
+	jobExpiry, err := time.ParseDuration(jobTTL)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if handlers.TrustedProxies, err = handlers.ParseTrustedProxies(proxies); err != nil {
+		logger.Fatal(err)
+	}
+
+	validation.MaxDepth, err = strconv.Atoi(nestingDepth)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	retentionInterval, err := time.ParseDuration(retention)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	handlers.IdempotencyKeys = handlers.NewMemoryIdempotencyStore(idempotencyTTL)
+	handlers.WriteRateLimiter = handlers.NewRateLimiter()
+
+	storage := handlers.NewMongoStorage(mongoURL, databaseName, handlers.UnorderedWrites(unorderedWrites))
+	handlers.DataSetStorage = storage
+
+	// writes are only journaled if there is somewhere to keep them
+	if journalDir != "" {
+		journal, err := handlers.NewJournaledStorage(journalDir, storage, logger)
+
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		handlers.DataSetStorage = journal
+
+		go journal.Run(replayInterval, nil)
+	}
+
+	// asynchronous writes are only queued if there is somewhere to keep them
+	if jobDir != "" {
+		if handlers.Jobs, err = handlers.NewJobQueue(jobDir, jobExpiry); err != nil {
+			logger.Fatal(err)
+		}
+
+		go handlers.Jobs.Run(logger, nil)
+	}
+
+	// requests are only audited if there is somewhere to keep the log
+	if auditLog != "" {
+		if handlers.AuditLog, err = handlers.NewFileAuditStore(auditLog); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	// a zero interval turns off the retention reaper
+	if retentionInterval > 0 {
+		go handlers.RunRetentionReaper(retentionInterval, logger, nil)
+	}
+
 	go serve(":"+port, handlers.NewHandler(maxBody, logger), wg, logger)
 	wg.Wait()
 }
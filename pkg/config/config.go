@@ -20,12 +20,38 @@ type DataSetMetaData struct {
 	UploadFormat    string          `json:"upload_format"`
 	UploadFilters   []string        `json:"upload_filters"`
 	AutoIds         []string        `json:"auto_ids"`
+	AutoIDStrategy  string          `json:"auto_id_strategy"`
 	Queryable       bool            `json:"queryable"`
 	Realtime        bool            `json:"realtime"`
 	CappedSize      int64           `json:"capped_size"`
 	MaxExpectedAge  *int64          `json:"max_age_expected"`
+	Retention       string          `json:"retention"`
+	Versioned       bool            `json:"versioned"`
+	RateLimits      *RateLimits     `json:"rate_limits"`
 	Published       bool            `json:"published"`
 	Schema          json.RawMessage `json:"schema"`
+	ComputedFields  []ComputedField `json:"computed_fields"`
+	CoerceTypes     bool            `json:"coerce_types"`
+}
+
+// ComputedField is a field which is calculated from the other fields of each
+// record when it is written, using the expression package.
+type ComputedField struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// RateLimits limits how quickly requests and records can be written.
+type RateLimits struct {
+	Requests RateLimit `json:"requests"`
+	Records  RateLimit `json:"records"`
+}
+
+// RateLimit allows PerSecond events a second on average, in bursts of up to
+// Burst events. A zero PerSecond means no limit.
+type RateLimit struct {
+	PerSecond float64 `json:"per_second"`
+	Burst     int     `json:"burst"`
 }
 
 // Client defines the interface that we need to talk to the meta data API
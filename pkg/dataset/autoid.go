@@ -0,0 +1,103 @@
+package dataset
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AutoIDStrategy generates an _id from the values of a record's auto ID fields.
+type AutoIDStrategy func(values []string) string
+
+var autoIDStrategies = map[string]AutoIDStrategy{
+	"base64": base64AutoID,
+	"sha256": sha256AutoID,
+	"uuid5":  uuid5AutoID,
+}
+
+// RegisterAutoIDStrategy makes an AutoIDStrategy available to DataSets by name.
+func RegisterAutoIDStrategy(name string, strategy AutoIDStrategy) {
+	autoIDStrategies[name] = strategy
+}
+
+// autoIDStrategy returns the strategy named in DataSetMetaData.AutoIDStrategy.
+// DataSets without one use base64, as backdrop did.
+func (d DataSet) autoIDStrategy() (AutoIDStrategy, error) {
+	name := d.MetaData.AutoIDStrategy
+	if name == "" {
+		name = "base64"
+	}
+
+	strategy, ok := autoIDStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown auto ID strategy '%s' for %s", name, d.Name())
+	}
+	return strategy, nil
+}
+
+// base64AutoID joins the values with dots and base64 encodes them, which
+// matches the IDs that backdrop generated.
+func base64AutoID(values []string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(values, ".")))
+}
+
+// sha256AutoID is a fixed length hex encoded hash of the values.
+func sha256AutoID(values []string) string {
+	sum := sha256.Sum256([]byte(joinAutoIDValues(values)))
+	return hex.EncodeToString(sum[:])
+}
+
+// uuid5AutoID is a name based UUID, as described in RFC 4122, of the values.
+func uuid5AutoID(values []string) string {
+	u := uuid5(autoIDNamespace, joinAutoIDValues(values))
+	encoded := hex.EncodeToString(u)
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:32]
+}
+
+// joinAutoIDValues joins values with a separator which won't appear in them,
+// so that different values can't give the same ID.
+func joinAutoIDValues(values []string) string {
+	return strings.Join(values, "\x1f")
+}
+
+var (
+	// urlNamespace is the RFC 4122 namespace for URLs
+	urlNamespace = []byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	// autoIDNamespace is the namespace for the UUIDs which uuid5AutoID generates
+	autoIDNamespace = uuid5(urlNamespace, "https://github.com/alphagov/performance-datastore/auto-id")
+)
+
+// uuid5 returns the bytes of the version 5 UUID for name in namespace.
+func uuid5(namespace []byte, name string) []byte {
+	hash := sha1.New()
+	hash.Write(namespace)
+	hash.Write([]byte(name))
+	u := hash.Sum(nil)[:16]
+
+	u[6] = (u[6] & 0x0f) | 0x50 // version 5
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return u
+}
+
+// autoIDValue formats a field's value for an auto ID. Only scalar values can
+// be used.
+func autoIDValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), true
+	}
+	return "", false
+}
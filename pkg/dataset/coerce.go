@@ -0,0 +1,125 @@
+package dataset
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alphagov/performance-datastore/pkg/utils"
+	"github.com/alphagov/performance-datastore/pkg/validation"
+)
+
+// CoerceTypes converts string values to the numbers and booleans that this
+// DataSet's schema says they should be, if the DataSet has coerce_types set.
+// Values which can't be converted are appended to the provided error array.
+// Dates are converted by CoerceDateTimes, after the schema has been checked.
+func (d DataSet) CoerceTypes(data []map[string]interface{}, errors *[]error) error {
+	return d.coerce(data, errors, coerceType)
+}
+
+// CoerceDateTimes converts string values to time.Time where this DataSet's
+// schema gives them the date-time format, if the DataSet has coerce_types set.
+// Values which can't be converted are appended to the provided error array.
+func (d DataSet) CoerceDateTimes(data []map[string]interface{}, errors *[]error) error {
+	return d.coerce(data, errors, coerceDateTime)
+}
+
+type coercion func(key string, value string, property schemaProperty) (interface{}, *RecordError)
+
+func (d DataSet) coerce(data []map[string]interface{}, errors *[]error, convert coercion) error {
+	if !d.MetaData.CoerceTypes || d.MetaData.Schema == nil {
+		return nil
+	}
+
+	schema, err := schemas.get(d.Name(), d.MetaData.Schema)
+	if err != nil {
+		return fmt.Errorf("The schema for %s is invalid: %v", d.Name(), err)
+	}
+
+	keys := make([]string, 0, len(schema.properties))
+	for key := range schema.properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, r := range data {
+		for _, key := range keys {
+			property := schema.properties[key]
+			value, ok := r[key].(string)
+			if !ok {
+				continue
+			}
+
+			coerced, recordErr := convert(key, value, property)
+			if recordErr != nil {
+				recordErr.Index = i
+				recordErr.Path = fmt.Sprintf("/%d%s", i, recordErr.Path)
+				*errors = append(*errors, recordErr)
+				continue
+			}
+			r[key] = coerced
+		}
+	}
+
+	return nil
+}
+
+func coerceType(key string, value string, property schemaProperty) (interface{}, *RecordError) {
+	trimmed := strings.TrimSpace(value)
+
+	switch property.Type {
+	case "number", "integer":
+		parsed, err := utils.ParseNumber(trimmed)
+		if err != nil {
+			return nil, newCoercionError(key, "%s must be a number but was %q", key, value)
+		}
+		number, ok := parsed.(float64)
+		if !ok {
+			return parsed, nil
+		}
+		if math.IsInf(number, 0) || math.IsNaN(number) {
+			return nil, newCoercionError(key, "%s must be a number but was %q", key, value)
+		}
+		if property.Type == "integer" {
+			if number != math.Trunc(number) {
+				return nil, newCoercionError(key, "%s must be an integer but was %q", key, value)
+			}
+			if math.Abs(number) < math.MaxInt64 {
+				return int64(number), nil
+			}
+		}
+		return number, nil
+	case "boolean":
+		b, err := strconv.ParseBool(trimmed)
+		if err != nil {
+			return nil, newCoercionError(key, "%s must be true or false but was %q", key, value)
+		}
+		return b, nil
+	}
+
+	return value, nil
+}
+
+func coerceDateTime(key string, value string, property schemaProperty) (interface{}, *RecordError) {
+	if property.Type != "string" || property.Format != "date-time" || key == "_timestamp" {
+		return value, nil
+	}
+
+	t := validation.ParseDateTime(value)
+	if t == nil {
+		return nil, newCoercionError(key, "%s must be an ISO8601 date-time but was %q", key, value)
+	}
+	return *t, nil
+}
+
+// newCoercionError returns a RecordError for key, which coerce fills in with
+// the index of the record.
+func newCoercionError(key string, format string, args ...interface{}) *RecordError {
+	return &RecordError{
+		Path:   "/" + escapeJSONPointer(key),
+		Code:   UncoercibleValueCode,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
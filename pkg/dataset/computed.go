@@ -0,0 +1,101 @@
+package dataset
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/alphagov/performance-datastore/pkg/config"
+	"github.com/alphagov/performance-datastore/pkg/expression"
+	"github.com/alphagov/performance-datastore/pkg/validation"
+)
+
+// expressionCache holds the compiled computed fields for each DataSet, so
+// that we don't compile them again for every write. An entry is replaced when
+// the computed fields from the config API change.
+type expressionCache struct {
+	sync.RWMutex
+	expressions map[string]cachedExpressions
+}
+
+type cachedExpressions struct {
+	source      string
+	expressions []*expression.Expression
+}
+
+var computedFields = &expressionCache{expressions: make(map[string]cachedExpressions)}
+
+// get returns the compiled expression for each of the computed fields of the
+// DataSet name, in the same order.
+func (c *expressionCache) get(name string, fields []config.ComputedField) ([]*expression.Expression, error) {
+	sources := make([]string, len(fields))
+	for i, computed := range fields {
+		sources[i] = computed.Name + "=" + computed.Expression
+	}
+	source := strings.Join(sources, "\n")
+
+	c.RLock()
+	cached, ok := c.expressions[name]
+	c.RUnlock()
+
+	if ok && cached.source == source {
+		return cached.expressions, nil
+	}
+
+	expressions := make([]*expression.Expression, len(fields))
+	for i, computed := range fields {
+		if !validation.IsValidKey(computed.Name) || validation.IsInternalKey(computed.Name) {
+			return nil, fmt.Errorf("%s can't be the name of a computed field", computed.Name)
+		}
+
+		e, err := expression.Compile(computed.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to compile the computed field %s: %v", computed.Name, err)
+		}
+		expressions[i] = e
+	}
+
+	c.Lock()
+	c.expressions[name] = cachedExpressions{source, expressions}
+	c.Unlock()
+
+	return expressions, nil
+}
+
+// ComputeFields sets this DataSet's computed fields on each JSON record, in
+// the order they are declared so that later fields can use earlier ones. If a
+// field can't be computed for a record, the problem is appended to the
+// provided error array. An error is returned if the computed fields are
+// misconfigured.
+func (d DataSet) ComputeFields(data []map[string]interface{}, errors *[]error) error {
+	if len(d.MetaData.ComputedFields) == 0 {
+		return nil
+	}
+
+	expressions, err := computedFields.get(d.Name(), d.MetaData.ComputedFields)
+	if err != nil {
+		return fmt.Errorf("The computed fields for %s are invalid: %v", d.Name(), err)
+	}
+
+	for i, r := range data {
+		for j, computed := range d.MetaData.ComputedFields {
+			value, err := expressions[j].Evaluate(r)
+			if err != nil {
+				*errors = append(*errors, newRecordError(i, computed.Name, ComputedFieldCode, "%s could not be computed: %v", computed.Name, err))
+				break
+			}
+			if number, ok := value.(float64); ok && (math.IsNaN(number) || math.IsInf(number, 0)) {
+				*errors = append(*errors, newRecordError(i, computed.Name, ComputedFieldCode, "%s computed %v, which isn't a finite number", computed.Name, value))
+				break
+			}
+			if !validation.IsValidValue(value) {
+				*errors = append(*errors, newRecordError(i, computed.Name, InvalidValueCode, "%s computed an invalid value %v", computed.Name, value))
+				break
+			}
+			r[computed.Name] = value
+		}
+	}
+
+	return nil
+}
@@ -1,25 +1,73 @@
 package dataset
 
 import (
-	"encoding/base64"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/alphagov/performance-datastore/pkg/config"
-	"github.com/alphagov/performance-datastore/pkg/utils"
 	"github.com/alphagov/performance-datastore/pkg/validation"
-	"github.com/xeipuuv/gojsonschema"
 )
 
 // DataSetStorage defines behaviours that we expect our API to persistent storage to provide.
 type DataSetStorage interface {
 	Create(name string, cappedSize int64) error
-	Exists(name string) bool
+	Exists(name string) (bool, error)
 	Empty(name string) error
 	Alive() bool
-	LastUpdated(name string) *time.Time
-	SaveRecord(name string, record map[string]interface{}) error
+	LastUpdated(name string) (*time.Time, error)
+	// SaveRecords saves the records in the named DataSet, replacing any existing
+	// records with the same _id. Either every record is saved or, if an error is
+	// returned, none of them are.
+	SaveRecords(name string, records []map[string]interface{}) (WriteResult, error)
+	// Replace atomically swaps the contents of the named DataSet for records,
+	// so that readers see either the old or the new records but never a mixture.
+	Replace(name string, cappedSize int64, records []map[string]interface{}) error
+	// DeleteRecords removes the records in the named DataSet which match filter,
+	// returning the number of records removed.
+	DeleteRecords(name string, filter RecordFilter) (int, error)
+	// CountRecords returns the number of records in the named DataSet which match filter.
+	CountRecords(name string, filter RecordFilter) (int, error)
+	// FindRecords returns at most limit of the records in the named DataSet
+	// which match filter.
+	FindRecords(name string, filter RecordFilter, limit int) ([]map[string]interface{}, error)
+}
+
+// VersionedStorage is a DataSetStorage which can keep the earlier versions of
+// records, for DataSets which are versioned. Each version of a record has a
+// _valid_from time, and the versions which have been replaced or removed also
+// have a _valid_to time.
+type VersionedStorage interface {
+	DataSetStorage
+	// SaveVersions saves the records like SaveRecords, but keeps the versions
+	// they replace, as valid until now.
+	SaveVersions(name string, records []map[string]interface{}, now time.Time) (WriteResult, error)
+	// ReplaceVersions atomically swaps the contents of the named DataSet for
+	// records like Replace, but keeps the records it replaces as versions
+	// which were valid until now.
+	ReplaceVersions(name string, cappedSize int64, records []map[string]interface{}, now time.Time) error
+	// RetireRecords removes the records in the named DataSet which match
+	// filter, but keeps them as versions which were valid until now. It
+	// returns the number of records removed.
+	RetireRecords(name string, filter RecordFilter, now time.Time) (int, error)
+	// DeleteVersions removes the earlier versions of records in the named
+	// DataSet which match filter, returning the number of versions removed.
+	DeleteVersions(name string, filter RecordFilter) (int, error)
+}
+
+// RecordFilter selects records in a DataSet. A non-empty ID selects the single
+// record with that _id, otherwise records must match every FilterBy value and
+// have a _timestamp in the range [StartAt, EndAt). FilterBy values are given
+// as strings, and match numbers and booleans which they are the text of.
+// If AsOf is set, the records are selected from the DataSet as it was at that
+// time, which includes earlier versions of the records in a versioned DataSet.
+type RecordFilter struct {
+	ID       string
+	FilterBy map[string][]string
+	StartAt  *time.Time
+	EndAt    *time.Time
+	AsOf     *time.Time
 }
 
 // DataSet is the data type for a data set
@@ -28,6 +76,15 @@ type DataSet struct {
 	MetaData config.DataSetMetaData
 }
 
+// WriteResult summarises the outcome of writing records to a DataSet.
+type WriteResult struct {
+	Inserted int
+	Updated  int
+	// Journaled is the number of records which were accepted but couldn't be
+	// written yet, because storage is unavailable.
+	Journaled int
+}
+
 // StalenessResult defines what is returned when we query to see how stale a DataSet is.
 type StalenessResult struct {
 	MaxExpectedAge   *int64
@@ -50,11 +107,15 @@ func (d DataSet) IsPublished() bool {
 	return d.MetaData.Published
 }
 
-// IsStale returns an appropriate StalenessResult for the given DataSet
-func (d DataSet) IsStale() (r StalenessResult) {
+// IsStale returns an appropriate StalenessResult for the given DataSet, or an
+// error if storage can't say when it was last updated.
+func (d DataSet) IsStale() (r StalenessResult, err error) {
 	expectedMaxAge := d.getMaxExpectedAge()
 	now := time.Now()
-	lastUpdated := d.getLastUpdated()
+	lastUpdated, err := d.getLastUpdated()
+	if err != nil {
+		return
+	}
 
 	r = StalenessResult{expectedMaxAge, lastUpdated, 0}
 
@@ -67,18 +128,130 @@ func (d DataSet) IsStale() (r StalenessResult) {
 
 // Append the array of JSON records to this DataSet.
 // Tranparently creates the DataSet if it doesn't already exist and stores the data.
-// Any errors in validating the data will be returned.
-func (d DataSet) Append(data []interface{}) []error {
-	d.createIfNecessary()
+// Records with an _id replace any existing record with the same _id.
+// Either all of the records are stored or none of them are. If the data fails
+// validation then the returned error is a ValidationErrors.
+func (d DataSet) Append(data []interface{}) (WriteResult, error) {
+	if err := d.createIfNecessary(); err != nil {
+		return WriteResult{}, err
+	}
 	return d.store(data)
 }
 
+// Replace the contents of this DataSet with the array of JSON records.
+// The records are validated in the same way as Append, and if there are any
+// validation errors a ValidationErrors is returned and the existing records are
+// left untouched. An empty array empties the DataSet.
+func (d DataSet) Replace(data []interface{}) error {
+	if len(data) == 0 {
+		return d.Empty()
+	}
+
+	records, errors, err := d.prepare(data)
+
+	if err != nil {
+		return err
+	}
+
+	if len(errors) > 0 {
+		return ValidationErrors(errors)
+	}
+
+	stampUpdatedAt(records)
+
+	if d.IsVersioned() {
+		return d.replaceVersions(records)
+	}
+
+	if err := d.Storage.Replace(d.Name(), d.CappedSize(), records); err != nil {
+		return fmt.Errorf("Unable to replace the records in %s: %v", d.Name(), err)
+	}
+
+	return nil
+}
+
+// replaceVersions replaces the records in a versioned DataSet as atomically
+// as Replace does in other DataSets, keeping the records it replaces as
+// earlier versions.
+func (d DataSet) replaceVersions(records []map[string]interface{}) error {
+	storage, err := d.versionedStorage()
+	if err != nil {
+		return err
+	}
+
+	if err := d.createIfNecessary(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	stampValidFrom(records, now)
+
+	if err := storage.ReplaceVersions(d.Name(), d.CappedSize(), records, now); err != nil {
+		return fmt.Errorf("Unable to replace the records in %s: %v", d.Name(), err)
+	}
+
+	return nil
+}
+
 // Empty this DataSet of all existing records, creating the DataSet if necessary.
+// A versioned DataSet keeps the records it is emptied of as earlier versions.
 func (d DataSet) Empty() error {
-	d.createIfNecessary()
+	if err := d.createIfNecessary(); err != nil {
+		return err
+	}
+
+	if d.IsVersioned() {
+		_, err := d.retire(RecordFilter{})
+		return err
+	}
+
 	return d.Storage.Empty(d.Name())
 }
 
+// Delete removes the records in this DataSet which match filter, returning
+// the number of records removed. A versioned DataSet keeps the records it
+// removes as earlier versions.
+func (d DataSet) Delete(filter RecordFilter) (int, error) {
+	if d.IsVersioned() {
+		return d.retire(filter)
+	}
+	return d.Storage.DeleteRecords(d.Name(), filter)
+}
+
+func (d DataSet) retire(filter RecordFilter) (int, error) {
+	storage, err := d.versionedStorage()
+	if err != nil {
+		return 0, err
+	}
+	return storage.RetireRecords(d.Name(), filter, time.Now())
+}
+
+// IsVersioned returns true if this DataSet keeps the earlier versions of its
+// records, rather than overwriting or removing them.
+func (d DataSet) IsVersioned() bool {
+	return d.MetaData.Versioned
+}
+
+func (d DataSet) versionedStorage() (VersionedStorage, error) {
+	storage, ok := d.Storage.(VersionedStorage)
+	if !ok {
+		return nil, fmt.Errorf("%s is versioned, but its storage can't keep earlier versions of records", d.Name())
+	}
+	return storage, nil
+}
+
+// Count returns the number of records in this DataSet which match filter.
+func (d DataSet) Count(filter RecordFilter) (int, error) {
+	return d.Storage.CountRecords(d.Name(), filter)
+}
+
+// Find returns at most limit of the records in this DataSet which match
+// filter. With an AsOf time, the earlier versions of records which were
+// current then are found too, with the _id of the record they are a version of.
+func (d DataSet) Find(filter RecordFilter, limit int) ([]map[string]interface{}, error) {
+	return d.Storage.FindRecords(d.Name(), filter, limit)
+}
+
 func (d DataSet) isRealtime() bool {
 	return d.MetaData.Realtime
 }
@@ -115,7 +288,7 @@ func (d DataSet) Name() string {
 	return d.MetaData.Name
 }
 
-func (d DataSet) getLastUpdated() (t *time.Time) {
+func (d DataSet) getLastUpdated() (*time.Time, error) {
 	return d.Storage.LastUpdated(d.Name())
 }
 
@@ -126,36 +299,98 @@ func isStalenessAppropriate(maxAge *int64, lastUpdated *time.Time) bool {
 	return maxAge != nil && lastUpdated != nil
 }
 
-func (d DataSet) createIfNecessary() {
-	if !d.collectionExists(d.Name()) {
-		err := d.createCollection()
-		if err != nil {
-			panic(err)
+func (d DataSet) createIfNecessary() error {
+	exists, err := d.collectionExists(d.Name())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return d.createCollection()
+	}
+	return nil
+}
+
+func (d DataSet) store(data []interface{}) (WriteResult, error) {
+	records, errors, err := d.prepare(data)
+
+	if err != nil {
+		return WriteResult{}, err
+	}
+
+	if len(errors) > 0 {
+		return WriteResult{}, ValidationErrors(errors)
+	}
+
+	stampUpdatedAt(records)
+
+	var result WriteResult
+	if d.IsVersioned() {
+		var storage VersionedStorage
+		if storage, err = d.versionedStorage(); err != nil {
+			return WriteResult{}, err
 		}
+		now := time.Now()
+		stampValidFrom(records, now)
+		result, err = storage.SaveVersions(d.Name(), records, now)
+	} else {
+		result, err = d.Storage.SaveRecords(d.Name(), records)
 	}
+
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("Unable to save records to %s: %v", d.Name(), err)
+	}
+
+	return result, nil
 }
 
-func (d DataSet) store(data []interface{}) (errors []error) {
+// Validate runs the array of JSON records through the same validation and
+// transformation as Append without storing anything. It returns the records in
+// the form that they would be stored, along with any validation errors.
+func (d DataSet) Validate(data []interface{}) ([]map[string]interface{}, error) {
+	records, errors, err := d.prepare(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(errors) > 0 {
+		return records, ValidationErrors(errors)
+	}
+
+	return records, nil
+}
 
-	records := unwrap(data)
+// prepare validates the JSON records and converts them into the form that we persist.
+// If there are validation errors the records may have only been partly converted.
+// An error is returned if the DataSet is misconfigured.
+func (d DataSet) prepare(data []interface{}) (records []map[string]interface{}, errors []error, err error) {
+	records = unwrap(data)
 
-	d.ValidateAgainstSchema(records, &errors)
-	d.ProcessAutoIDs(records, &errors)
+	if err = d.CoerceTypes(records, &errors); err != nil {
+		return
+	}
+	if err = d.ValidateAgainstSchema(records, &errors); err != nil {
+		return
+	}
+	if err = d.CoerceDateTimes(records, &errors); err != nil {
+		return
+	}
+	if err = d.ProcessAutoIDs(records, &errors); err != nil {
+		return
+	}
 	d.ParseTimestamps(records, &errors)
+	if err = d.ComputeFields(records, &errors); err != nil {
+		return
+	}
 	d.ValidateRecords(records, &errors)
 
 	if len(errors) > 0 {
-		return errors
+		sort.Stable(byRecordIndex(errors))
+		return
 	}
 
 	d.AddPeriodData(records)
 
-	for _, record := range records {
-		if err := d.saveRecord(record); err != nil {
-			panic(err)
-		}
-	}
-
 	return
 }
 
@@ -171,31 +406,38 @@ func unwrap(data []interface{}) []map[string]interface{} {
 
 // ValidateAgainstSchema validates all JSON records that we're trying to write to this
 // DataSet against any JSON schema that this DataSet has. If there are schema
-// validation errors, these are appended to the provided error array.
-func (d DataSet) ValidateAgainstSchema(data []map[string]interface{}, errors *[]error) {
-	schema := d.MetaData.Schema
-
-	if schema != nil {
-		var jsonDoc map[string]interface{}
-		err := utils.Unmarshal(d.MetaData.Schema, &jsonDoc)
+// validation errors, these are appended to the provided error array. An error
+// is returned if the schema itself is invalid.
+func (d DataSet) ValidateAgainstSchema(data []map[string]interface{}, errors *[]error) error {
+	if d.MetaData.Schema == nil {
+		return nil
+	}
 
-		if err != nil {
-			panic(err)
-		}
+	schema, err := schemas.get(d.Name(), d.MetaData.Schema)
+	if err != nil {
+		return fmt.Errorf("The schema for %s is invalid: %v", d.Name(), err)
+	}
 
-		schemaDocument, err := gojsonschema.NewJsonSchemaDocument(jsonDoc)
-		if err != nil {
-			panic(err)
-		}
-		for _, r := range data {
-			result := schemaDocument.Validate(r)
-			if !result.Valid() {
-				for _, err := range result.Errors() {
-					*errors = append(*errors, fmt.Errorf(err.Description))
-				}
+	for i, r := range data {
+		result := schema.document.Validate(r)
+		if !result.Valid() {
+			for _, err := range result.Errors() {
+				*errors = append(*errors, newNestedRecordError(i, schemaErrorPath(err.Field()), SchemaViolationCode, "%s", err.Description))
 			}
 		}
 	}
+
+	return nil
+}
+
+// schemaErrorPath turns the field of a schema validation error, such as
+// count or person.tags.0, into the keys and array indexes that lead to it.
+// Errors about the whole record have the field (root).
+func schemaErrorPath(field string) []string {
+	if field == "" || field == "(root)" {
+		return nil
+	}
+	return strings.Split(field, ".")
 }
 
 // AddPeriodData adds period data information (timestamp etc) to each JSON record
@@ -227,71 +469,80 @@ func addPeriodData(record map[string]interface{}) {
 // DataSet against any validation criteria that this DataSet has. If there are
 // validation errors, these are appended to the provided error array.
 func (d DataSet) ValidateRecords(data []map[string]interface{}, errors *[]error) {
-	for _, r := range data {
-		validateRecord(r, errors)
+	for i, r := range data {
+		validateRecord(i, r, errors)
 	}
 }
 
-func (d DataSet) saveRecord(record map[string]interface{}) error {
-	record["_updated_at"] = time.Now()
-	return d.Storage.SaveRecord(d.Name(), record)
+func stampUpdatedAt(records []map[string]interface{}) {
+	now := time.Now()
+	for _, record := range records {
+		record["_updated_at"] = now
+	}
+}
+
+func stampValidFrom(records []map[string]interface{}, now time.Time) {
+	for _, record := range records {
+		record["_valid_from"] = now
+	}
 }
 
 // ParseTimestamps looks at each JSON record for a string _timestamp field and
 // tries to convert it to a time.Time. If a _timestamp field isn't in the expected
 // format, then errors will be appended to the provide error array.
 func (d DataSet) ParseTimestamps(data []map[string]interface{}, errors *[]error) {
-	for _, r := range data {
-		parseTimestamp(r, errors)
+	for i, r := range data {
+		parseTimestamp(i, r, errors)
 	}
 }
 
-func parseTimestamp(record map[string]interface{}, errors *[]error) {
+func parseTimestamp(index int, record map[string]interface{}, errors *[]error) {
 	current, hasTimestamp := record["_timestamp"]
 
 	if hasTimestamp {
-		if res, err := tryParseTimestamp(current); err != nil {
-			*errors = append(*errors, err)
-		} else {
+		if res := validation.ParseDateTime(current); res != nil {
 			record["_timestamp"] = *res
+		} else {
+			*errors = append(*errors, newRecordError(index, "_timestamp", InvalidTimestampCode,
+				"_timestamp is not a valid timestamp, it must be ISO8601"))
 		}
 	}
 }
 
-func tryParseTimestamp(t interface{}) (*time.Time, error) {
-	res := validation.ParseDateTime(t)
-	if res != nil {
-		return res, nil
+// ProcessAutoIDs looks at any auto_id fields in this DataSet and generates appropriate values,
+// using the DataSet's auto ID strategy. If any fields needed to generate an auto ID are missing
+// or can't be used in an ID, then errors are appended to the provided error array. An error is
+// returned if the strategy doesn't exist.
+func (d DataSet) ProcessAutoIDs(data []map[string]interface{}, errors *[]error) error {
+	if len(d.MetaData.AutoIds) == 0 || len(data) == 0 {
+		return nil
 	}
 
-	return nil, fmt.Errorf("_timestamp is not a valid timestamp, it must be ISO8601")
-}
+	strategy, err := d.autoIDStrategy()
+	if err != nil {
+		return err
+	}
 
-// ProcessAutoIDs looks at any auto_id fields in this DataSet and generates appropriate values.
-// If any required fields needed to generate an auto ID are missing, then errors are appended
-// to the provided error array.
-func (d DataSet) ProcessAutoIDs(data []map[string]interface{}, errors *[]error) interface{} {
-	if len(d.MetaData.AutoIds) > 0 && len(data) != 0 {
-		return addAutoIDs(data, d.MetaData.AutoIds, errors)
+	for i, record := range data {
+		addAutoID(i, record, d.MetaData.AutoIds, strategy, errors)
 	}
-	return data
+	return nil
 }
 
-func validateRecord(record map[string]interface{}, errors *[]error) {
+func validateRecord(index int, record map[string]interface{}, errors *[]error) {
 	for k, v := range record {
 		if !validation.IsValidKey(k) {
-			*errors = append(*errors, fmt.Errorf("%v is not a valid key", k))
+			*errors = append(*errors, newRecordError(index, k, InvalidKeyCode, "%v is not a valid key", k))
 			return
 		}
 
 		if validation.IsInternalKey(k) &&
 			!validation.IsReservedKey(k) {
-			*errors = append(*errors, fmt.Errorf("%v is not a recognised internal field", k))
+			*errors = append(*errors, newRecordError(index, k, UnrecognisedInternalCode, "%v is not a recognised internal field", k))
 			return
 		}
 
-		if !validation.IsValidValue(v) {
-			*errors = append(*errors, fmt.Errorf("%v has an invalid value", k))
+		if !validateValue(index, k, v, errors) {
 			return
 		}
 
@@ -300,64 +551,68 @@ func validateRecord(record map[string]interface{}, errors *[]error) {
 			case time.Time:
 			default:
 				{
-					*errors = append(*errors, fmt.Errorf("_timestamp is not a valid datetime object"))
+					*errors = append(*errors, newRecordError(index, k, InvalidTimestampCode, "_timestamp is not a valid datetime object"))
 					return
 				}
 			}
 		}
 
 		if k == "_id" && !validation.IsValidID(v) {
-			*errors = append(*errors, fmt.Errorf("id is not a valid ID"))
+			*errors = append(*errors, newRecordError(index, k, InvalidIDCode, "id is not a valid ID"))
 			return
 		}
 	}
 }
 
-func addAutoIDs(data []map[string]interface{}, autoIds []string, errors *[]error) interface{} {
-	for _, record := range data {
-		addAutoID(record, autoIds, errors)
+// validateValue checks a value of a record, and any objects and arrays
+// nested inside it, reporting the first problem it finds.
+func validateValue(index int, key string, value interface{}, errors *[]error) bool {
+	problem := validation.CheckValue(value)
+	if problem == nil {
+		return true
 	}
 
-	return data
+	path := append([]string{key}, problem.Path...)
+	name := strings.Join(path, ".")
+
+	switch problem.Reason {
+	case validation.NestedTooDeep:
+		*errors = append(*errors, newNestedRecordError(index, path, NestedTooDeepCode,
+			"%v is nested more than %d deep", name, validation.MaxDepth))
+	case validation.InvalidKey:
+		*errors = append(*errors, newNestedRecordError(index, path, InvalidKeyCode, "%v is not a valid key", name))
+	case validation.InternalKey:
+		*errors = append(*errors, newNestedRecordError(index, path, UnrecognisedInternalCode, "%v is not a recognised internal field", name))
+	default:
+		*errors = append(*errors, newNestedRecordError(index, path, InvalidValueCode, "%v has an invalid value", name))
+	}
+	return false
 }
 
-func addAutoID(record map[string]interface{}, autoIds []string, errors *[]error) {
-	keys := make([]string, len(record))
-	i := 0
-	for k := range record {
-		keys[i] = k
-		i++
-	}
+func addAutoID(index int, record map[string]interface{}, autoIDs []string, strategy AutoIDStrategy, errors *[]error) {
+	values := make([]string, len(autoIDs))
+	valid := true
 
-	missingIDFields := []string{}
-	for _, id := range autoIds {
-		_, ok := record[id]
-		if !ok {
-			missingIDFields = append(missingIDFields, id)
+	for i, field := range autoIDs {
+		value, ok := record[field]
+		if !ok || value == nil {
+			*errors = append(*errors, newRecordError(index, field, MissingAutoIDFieldCode, "%s is required to generate an _id", field))
+			valid = false
+			continue
 		}
-	}
 
-	if len(missingIDFields) > 0 {
-		panic("The following required id fields are missing: " +
-			strings.Join(missingIDFields, " ,"))
+		if values[i], ok = autoIDValue(value); !ok {
+			*errors = append(*errors, newRecordError(index, field, UnsupportedAutoIDValueCode, "%s can't be used to generate an _id", field))
+			valid = false
+		}
 	}
 
-	record["_id"] = generateAutoID(record, autoIds)
-}
-
-func generateAutoID(record map[string]interface{}, autoIDs []string) string {
-	b := ""
-	for _, id := range autoIDs {
-		var sep = "."
-		if len(b) == 0 {
-			sep = ""
-		}
-		b = b + sep + string(record[id].(string))
+	if valid {
+		record["_id"] = strategy(values)
 	}
-	return base64.StdEncoding.EncodeToString([]byte(b))
 }
 
-func (d DataSet) collectionExists(name string) bool {
+func (d DataSet) collectionExists(name string) (bool, error) {
 	return d.Storage.Exists(name)
 }
 
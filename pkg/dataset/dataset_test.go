@@ -2,6 +2,7 @@ package dataset
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/alphagov/performance-datastore/pkg/config"
@@ -62,26 +63,77 @@ var _ = Describe("Dataset", func() {
 		It("Should not alter input when there are no auto IDs defined", func() {
 			record := Unmarshal(`{"foo": "foo", "bar": "bar"}`)
 			records := []map[string]interface{}{record}
-			actual := dataSet.ProcessAutoIDs(records, &errors)
-			Expect(records).Should(Equal(actual))
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
+			expected := Unmarshal(`{"foo": "foo", "bar": "bar"}`)
+			Expect([]map[string]interface{}{expected}).Should(Equal(records))
 		})
 
 		It("Should add an auto ID based on a single field", func() {
 			dataSet.MetaData.AutoIds = []string{"foo"}
 			record := Unmarshal(`{"foo": "foo", "bar": "bar"}`)
 			records := []map[string]interface{}{record}
-			actual := dataSet.ProcessAutoIDs(records, &errors)
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
 			expected := Unmarshal(`{"foo": "foo", "bar": "bar","_id": "Zm9v"}`)
-			Expect([]map[string]interface{}{expected}).Should(Equal(actual))
+			Expect([]map[string]interface{}{expected}).Should(Equal(records))
 		})
 
 		It("Should add an auto ID based on multiple fields", func() {
 			dataSet.MetaData.AutoIds = []string{"foo", "bar"}
 			record := Unmarshal(`{"foo": "foo", "bar": "bar"}`)
 			records := []map[string]interface{}{record}
-			actual := dataSet.ProcessAutoIDs(records, &errors)
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
 			expected := Unmarshal(`{"foo": "foo", "bar": "bar","_id": "Zm9vLmJhcg=="}`)
-			Expect([]map[string]interface{}{expected}).Should(Equal(actual))
+			Expect([]map[string]interface{}{expected}).Should(Equal(records))
+		})
+
+		It("Should use numbers, booleans and times in auto IDs", func() {
+			dataSet.MetaData.AutoIds = []string{"count", "done", "at"}
+			record := map[string]interface{}{"count": 1.5, "done": true, "at": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}
+			records := []map[string]interface{}{record}
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
+			Expect(errors).Should(BeEmpty())
+			Expect(record["_id"]).Should(Equal(base64AutoID([]string{"1.5", "true", "2014-01-01T00:00:00Z"})))
+		})
+
+		It("Should generate sha256 auto IDs", func() {
+			dataSet.MetaData.AutoIds = []string{"foo", "bar"}
+			dataSet.MetaData.AutoIDStrategy = "sha256"
+			records := []map[string]interface{}{Unmarshal(`{"foo": "foo", "bar": "bar"}`)}
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
+			Expect(records[0]["_id"]).Should(Equal("554d8b24bd75576b2b5df90e07c412d3772825970305b02ee8e99ae8787fe7f3"))
+		})
+
+		It("Should generate UUIDv5 auto IDs", func() {
+			dataSet.MetaData.AutoIds = []string{"foo", "bar"}
+			dataSet.MetaData.AutoIDStrategy = "uuid5"
+			records := []map[string]interface{}{
+				Unmarshal(`{"foo": "foo", "bar": "bar"}`),
+				Unmarshal(`{"foo": "foo", "bar": "bar"}`),
+				Unmarshal(`{"foo": "foo.bar", "bar": ""}`)}
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
+			Expect(records[0]["_id"]).Should(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+			Expect(records[1]["_id"]).Should(Equal(records[0]["_id"]))
+			Expect(records[2]["_id"]).ShouldNot(Equal(records[0]["_id"]))
+		})
+
+		It("Should report missing and unsupported fields for each record", func() {
+			dataSet.MetaData.AutoIds = []string{"foo", "bar"}
+			records := []map[string]interface{}{
+				Unmarshal(`{"foo": "foo", "bar": "bar"}`),
+				Unmarshal(`{"bar": {"baz": 1}}`)}
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(BeNil())
+			Expect(errors).Should(Equal([]error{
+				&RecordError{1, "/1/foo", MissingAutoIDFieldCode, "foo is required to generate an _id"},
+				&RecordError{1, "/1/bar", UnsupportedAutoIDValueCode, "bar can't be used to generate an _id"}}))
+			Expect(records[1]).ShouldNot(HaveKey("_id"))
+		})
+
+		It("Should fail when the strategy doesn't exist", func() {
+			dataSet.MetaData.Name = "the-dataset"
+			dataSet.MetaData.AutoIds = []string{"foo"}
+			dataSet.MetaData.AutoIDStrategy = "md5"
+			records := []map[string]interface{}{Unmarshal(`{"foo": "foo"}`)}
+			Expect(dataSet.ProcessAutoIDs(records, &errors)).Should(MatchError("Unknown auto ID strategy 'md5' for the-dataset"))
 		})
 	})
 
@@ -112,6 +164,8 @@ var _ = Describe("Dataset", func() {
 			expected := map[string]interface{}{"_timestamp": "invalid"}
 			Expect([]map[string]interface{}{expected}).Should(Equal(records))
 			Expect(errors[0].Error()).Should(Equal("_timestamp is not a valid timestamp, it must be ISO8601"))
+			Expect(errors[0].(*RecordError).Path).Should(Equal("/0/_timestamp"))
+			Expect(errors[0].(*RecordError).Code).Should(Equal(InvalidTimestampCode))
 		})
 	})
 
@@ -144,14 +198,40 @@ var _ = Describe("Dataset", func() {
 		})
 
 		It("Should not allow values that aren't whitelisted", func() {
-			record := Unmarshal(`{"id": ["foo", "bar"]}`)
+			record := map[string]interface{}{"id": []interface{}{"foo", struct{}{}}}
 			records := []map[string]interface{}{record}
 			dataSet.ValidateRecords(records, &errors)
 			Expect(len(errors)).Should(Equal(1))
-			expected := Unmarshal(`{"id": ["foo", "bar"]}`)
+			expected := map[string]interface{}{"id": []interface{}{"foo", struct{}{}}}
 			Expect([]map[string]interface{}{expected}).Should(Equal(records))
 		})
 
+		It("Should allow nested objects and arrays", func() {
+			record := Unmarshal(`{"device": {"os": "android", "versions": ["4.4", {"major": 5}]}, "tags": []}`)
+			records := []map[string]interface{}{record}
+			dataSet.ValidateRecords(records, &errors)
+			Expect(len(errors)).Should(Equal(0))
+		})
+
+		It("Should report problems inside nested objects and arrays", func() {
+			records := []map[string]interface{}{
+				Unmarshal(`{"device": {"os-name": "android"}}`),
+				Unmarshal(`{"device": {"_os": "android"}}`),
+				Unmarshal(`{"tags": ["a", {"b/c": 1}]}`)}
+			dataSet.ValidateRecords(records, &errors)
+			Expect(errors).Should(Equal([]error{
+				&RecordError{0, "/0/device/os-name", InvalidKeyCode, "device.os-name is not a valid key"},
+				&RecordError{1, "/1/device/_os", UnrecognisedInternalCode, "device._os is not a recognised internal field"},
+				&RecordError{2, "/2/tags/1/b~1c", InvalidKeyCode, "tags.1.b/c is not a valid key"}}))
+		})
+
+		It("Should not allow values nested too deeply", func() {
+			records := []map[string]interface{}{Unmarshal(`{"tags": [[[[[["too deep"]]]]]]}`)}
+			dataSet.ValidateRecords(records, &errors)
+			Expect(errors).Should(Equal([]error{
+				&RecordError{0, "/0/tags/0/0/0/0/0", NestedTooDeepCode, "tags.0.0.0.0.0 is nested more than 5 deep"}}))
+		})
+
 		It("Should only allow timestamps that look contain a time.Time instance", func() {
 			record := map[string]interface{}{"_timestamp": time.Date(2012, 12, 12, 0, 0, 0, 0, time.UTC)}
 			records := []map[string]interface{}{record}
@@ -170,6 +250,27 @@ var _ = Describe("Dataset", func() {
 			Expect([]map[string]interface{}{expected}).Should(Equal(records))
 		})
 
+		It("Should report the record index, JSON pointer and code for each error", func() {
+			records := []map[string]interface{}{
+				Unmarshal(`{"foo": "foo"}`),
+				Unmarshal(`{"_foo": "foo"}`),
+				Unmarshal(`{"a/b": "foo"}`)}
+			dataSet.ValidateRecords(records, &errors)
+			Expect(errors).Should(Equal([]error{
+				&RecordError{1, "/1/_foo", UnrecognisedInternalCode, "_foo is not a recognised internal field"},
+				&RecordError{2, "/2/a~1b", InvalidKeyCode, "a/b is not a valid key"}}))
+		})
+
+		It("Should move record errors on when offset", func() {
+			errors := ValidationErrors{
+				&RecordError{2, "/2/a~1b", InvalidKeyCode, "a/b is not a valid key"},
+				fmt.Errorf("not a record error")}
+			Expect(errors.Offset(10)).Should(Equal(ValidationErrors{
+				&RecordError{12, "/12/a~1b", InvalidKeyCode, "a/b is not a valid key"},
+				fmt.Errorf("not a record error")}))
+			Expect(errors[0].(*RecordError).Index).Should(Equal(2))
+		})
+
 		It("Should not allow a string with spaces as an _id", func() {
 			record := map[string]interface{}{"_id": "this should fail"}
 			records := []map[string]interface{}{record}
@@ -230,6 +331,15 @@ var _ = Describe("Dataset", func() {
 			Expect([]map[string]interface{}{expected}).Should(Equal(records))
 		})
 
+		It("Should point at the field which failed validation", func() {
+			dataSet.MetaData.Schema = json.RawMessage(`{"properties": {"counts": {"type": "array", "items": {"type": "number"}}}}`)
+			records := []map[string]interface{}{{"counts": []interface{}{1.0}}, {"counts": []interface{}{1.0, "two"}}}
+			dataSet.ValidateAgainstSchema(records, &errors)
+			Expect(errors).Should(HaveLen(1))
+			Expect(errors[0].(*RecordError).Index).Should(Equal(1))
+			Expect(errors[0].(*RecordError).Path).Should(Equal("/1/counts/1"))
+		})
+
 		It("date-time field is validated", func() {
 			record := map[string]interface{}{"_timestamp": "bar"}
 			records := []map[string]interface{}{record}
@@ -246,6 +356,127 @@ var _ = Describe("Dataset", func() {
 		})
 	})
 
+	Describe("Computed fields", func() {
+		BeforeEach(func() {
+			dataSet.MetaData.ComputedFields = []config.ComputedField{
+				{Name: "completion_rate", Expression: "completed / started"},
+				{Name: "percentage", Expression: "round(completion_rate * 100, 1)"}}
+		})
+
+		It("Should compute the fields in order", func() {
+			records := []map[string]interface{}{{"completed": 1.0, "started": 3.0}}
+			err := dataSet.ComputeFields(records, &errors)
+			Expect(err).Should(BeNil())
+			Expect(len(errors)).Should(Equal(0))
+			Expect(records[0]["completion_rate"]).Should(BeNumerically("~", 0.333, 0.001))
+			Expect(records[0]["percentage"]).Should(Equal(33.3))
+		})
+
+		It("Should report the records that a field can't be computed for", func() {
+			records := []map[string]interface{}{
+				{"completed": 1.0, "started": 3.0},
+				{"completed": 1.0, "started": 0.0}}
+			err := dataSet.ComputeFields(records, &errors)
+			Expect(err).Should(BeNil())
+			Expect(errors).Should(Equal([]error{
+				&RecordError{1, "/1/completion_rate", ComputedFieldCode, "completion_rate could not be computed: division by zero"}}))
+		})
+
+		It("Should allow booleans", func() {
+			dataSet.MetaData.ComputedFields = []config.ComputedField{{Name: "finished", Expression: "completed == started"}}
+			records := []map[string]interface{}{{"completed": int64(1), "started": 3.0}}
+			dataSet.ComputeFields(records, &errors)
+			Expect(errors).Should(BeEmpty())
+			Expect(records[0]["finished"]).Should(Equal(false))
+		})
+
+		It("Should fail when an expression doesn't compile", func() {
+			dataSet.MetaData.Name = "the-dataset"
+			dataSet.MetaData.ComputedFields = []config.ComputedField{{Name: "broken", Expression: "completed /"}}
+			err := dataSet.ComputeFields(nil, &errors)
+			Expect(err).Should(MatchError("The computed fields for the-dataset are invalid: Unable to compile the computed field broken: unexpected end of expression"))
+		})
+
+		It("Should report numbers which aren't finite", func() {
+			dataSet.MetaData.ComputedFields = []config.ComputedField{{Name: "huge", Expression: "count * 10"}}
+			records := []map[string]interface{}{{"count": 1e308}}
+			err := dataSet.ComputeFields(records, &errors)
+			Expect(err).Should(BeNil())
+			Expect(errors).Should(Equal([]error{
+				&RecordError{0, "/0/huge", ComputedFieldCode, "huge computed +Inf, which isn't a finite number"}}))
+			Expect(records[0]).ShouldNot(HaveKey("huge"))
+		})
+
+		It("Should not allow computed fields to set internal fields", func() {
+			dataSet.MetaData.Name = "the-dataset"
+			for _, name := range []string{"_timestamp", "_count", "not a key"} {
+				dataSet.MetaData.ComputedFields = []config.ComputedField{{Name: name, Expression: "1"}}
+				err := dataSet.ComputeFields(nil, &errors)
+				Expect(err).Should(MatchError("The computed fields for the-dataset are invalid: " + name + " can't be the name of a computed field"))
+			}
+		})
+
+		It("Should only compile the expressions once", func() {
+			dataSet.MetaData.Name = "the-dataset"
+			first, err := computedFields.get(dataSet.Name(), dataSet.MetaData.ComputedFields)
+			Expect(err).Should(BeNil())
+			second, err := computedFields.get(dataSet.Name(), dataSet.MetaData.ComputedFields)
+			Expect(err).Should(BeNil())
+			Expect(second[0] == first[0]).Should(BeTrue())
+
+			dataSet.MetaData.ComputedFields[1].Expression = "completion_rate * 100"
+			third, err := computedFields.get(dataSet.Name(), dataSet.MetaData.ComputedFields)
+			Expect(err).Should(BeNil())
+			Expect(third[1].String()).Should(Equal("completion_rate * 100"))
+		})
+	})
+
+	Describe("Versioning", func() {
+		It("Should fail when the storage can't keep earlier versions", func() {
+			dataSet.MetaData.Name = "the-dataset"
+			dataSet.MetaData.Versioned = true
+
+			_, err := dataSet.Delete(RecordFilter{ID: "an-id"})
+			Expect(err).Should(MatchError("the-dataset is versioned, but its storage can't keep earlier versions of records"))
+		})
+	})
+
+	Describe("Retention", func() {
+		now := time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC)
+
+		It("Should keep records forever without a retention period", func() {
+			cutoff, err := dataSet.RetentionCutoff(now)
+			Expect(err).Should(BeNil())
+			Expect(cutoff).Should(BeNil())
+
+			expired, err := dataSet.Expire(now, false)
+			Expect(err).Should(BeNil())
+			Expect(expired).Should(Equal(0))
+		})
+
+		It("Should count back from now by the retention period", func() {
+			for retention, expected := range map[string]time.Time{
+				"1 day":     time.Date(2015, 3, 30, 12, 0, 0, 0, time.UTC),
+				"2 weeks":   time.Date(2015, 3, 17, 12, 0, 0, 0, time.UTC),
+				"25 months": time.Date(2013, 3, 3, 12, 0, 0, 0, time.UTC),
+				"1 Year":    time.Date(2014, 3, 31, 12, 0, 0, 0, time.UTC)} {
+				dataSet.MetaData.Retention = retention
+				cutoff, err := dataSet.RetentionCutoff(now)
+				Expect(err).Should(BeNil())
+				Expect(*cutoff).Should(Equal(expected))
+			}
+		})
+
+		It("Should fail when the retention period can't be understood", func() {
+			dataSet.MetaData.Name = "the-dataset"
+			for _, retention := range []string{"25", "forever", "-1 days", "3 fortnights"} {
+				dataSet.MetaData.Retention = retention
+				_, err := dataSet.RetentionCutoff(now)
+				Expect(err).Should(MatchError(fmt.Sprintf("The retention period for the-dataset is invalid: %q", retention)))
+			}
+		})
+	})
+
 	Describe("Period Data", func() {
 		It("Should add period data for richer querying", func() {
 			record := map[string]interface{}{"_timestamp": time.Date(2012, 12, 12, 12, 12, 0, 0, time.UTC)}
@@ -0,0 +1,116 @@
+package dataset
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stable, machine readable codes for the problems that a RecordError can describe.
+const (
+	InvalidKeyCode             = "invalid_key"
+	UnrecognisedInternalCode   = "unrecognised_internal_field"
+	InvalidValueCode           = "invalid_value"
+	InvalidTimestampCode       = "invalid_timestamp"
+	InvalidIDCode              = "invalid_id"
+	SchemaViolationCode        = "schema_violation"
+	ComputedFieldCode          = "computed_field_error"
+	UncoercibleValueCode       = "uncoercible_value"
+	MissingAutoIDFieldCode     = "missing_auto_id_field"
+	UnsupportedAutoIDValueCode = "unsupported_auto_id_value"
+	NestedTooDeepCode          = "nested_too_deep"
+	RecordTooLargeCode         = "record_too_large"
+	UploadFilterCode           = "upload_filter_failed"
+	NotAnObjectCode            = "not_an_object"
+)
+
+// ValidationErrors is returned when records could not be written to a DataSet
+// because they failed validation. Nothing will have been written.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, ", ")
+}
+
+// RecordError describes a problem with a single record in a write request.
+type RecordError struct {
+	// Index is the position of the record in the request.
+	Index int
+	// Path is a JSON pointer to the problem, relative to the array of records.
+	Path string
+	// Code is one of the constants above, for clients to act on.
+	Code string
+	// Detail is a human readable description of the problem.
+	Detail string
+}
+
+func (e *RecordError) Error() string {
+	return e.Detail
+}
+
+// byRecordIndex sorts errors by the index of the record they refer to, so that
+// the problems with each record are reported together.
+type byRecordIndex []error
+
+func (e byRecordIndex) Len() int      { return len(e) }
+func (e byRecordIndex) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byRecordIndex) Less(i, j int) bool {
+	return recordIndex(e[i]) < recordIndex(e[j])
+}
+
+func recordIndex(err error) int {
+	if recordErr, ok := err.(*RecordError); ok {
+		return recordErr.Index
+	}
+	return -1
+}
+
+// newRecordError returns a RecordError for the field key of the record at index.
+// An empty key refers to the whole record.
+func newRecordError(index int, key string, code string, format string, args ...interface{}) *RecordError {
+	if key == "" {
+		return newNestedRecordError(index, nil, code, format, args...)
+	}
+	return newNestedRecordError(index, []string{key}, code, format, args...)
+}
+
+// newNestedRecordError returns a RecordError for a value nested inside the
+// record at index, found by following the keys and array indexes of path.
+func newNestedRecordError(index int, path []string, code string, format string, args ...interface{}) *RecordError {
+	pointer := fmt.Sprintf("/%d", index)
+	for _, token := range path {
+		pointer += "/" + escapeJSONPointer(token)
+	}
+
+	return &RecordError{
+		Index:  index,
+		Path:   pointer,
+		Code:   code,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// escapeJSONPointer escapes a reference token as described in RFC 6901
+func escapeJSONPointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// Offset returns a copy of the errors with the index of each RecordError moved
+// on by n, for when the records were validated in batches from a larger request.
+func (e ValidationErrors) Offset(n int) ValidationErrors {
+	offset := make(ValidationErrors, len(e))
+	for i, err := range e {
+		if recordErr, ok := err.(*RecordError); ok {
+			moved := *recordErr
+			moved.Index += n
+			moved.Path = fmt.Sprintf("/%d", moved.Index) +
+				strings.TrimPrefix(recordErr.Path, fmt.Sprintf("/%d", recordErr.Index))
+			err = &moved
+		}
+		offset[i] = err
+	}
+	return offset
+}
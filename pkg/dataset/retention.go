@@ -0,0 +1,76 @@
+package dataset
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionCutoff returns the time before which records in this DataSet have
+// expired, or nil if the DataSet keeps its records forever. Retention periods
+// are a number of days, weeks, months or years, like "25 months".
+// An error is returned if the retention period can't be understood.
+func (d DataSet) RetentionCutoff(now time.Time) (*time.Time, error) {
+	if d.MetaData.Retention == "" {
+		return nil, nil
+	}
+
+	fields := strings.Fields(strings.ToLower(d.MetaData.Retention))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("The retention period for %s is invalid: %q", d.Name(), d.MetaData.Retention)
+	}
+
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("The retention period for %s is invalid: %q", d.Name(), d.MetaData.Retention)
+	}
+
+	var cutoff time.Time
+	switch strings.TrimSuffix(fields[1], "s") {
+	case "day":
+		cutoff = now.AddDate(0, 0, -n)
+	case "week":
+		cutoff = now.AddDate(0, 0, -7*n)
+	case "month":
+		cutoff = now.AddDate(0, -n, 0)
+	case "year":
+		cutoff = now.AddDate(-n, 0, 0)
+	default:
+		return nil, fmt.Errorf("The retention period for %s is invalid: %q", d.Name(), d.MetaData.Retention)
+	}
+
+	return &cutoff, nil
+}
+
+// Expire removes the records in this DataSet with a _timestamp before its
+// retention cutoff, returning the number of records removed. If dryRun is set
+// the records are only counted. Nothing is removed from DataSets without a
+// retention period. Expired records are removed outright, even from versioned
+// DataSets, which lose their expired earlier versions too.
+func (d DataSet) Expire(now time.Time, dryRun bool) (int, error) {
+	cutoff, err := d.RetentionCutoff(now)
+	if err != nil || cutoff == nil {
+		return 0, err
+	}
+
+	filter := RecordFilter{EndAt: cutoff}
+	if dryRun {
+		return d.Count(filter)
+	}
+
+	if !d.IsVersioned() {
+		return d.Storage.DeleteRecords(d.Name(), filter)
+	}
+
+	storage, err := d.versionedStorage()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := storage.DeleteVersions(d.Name(), filter); err != nil {
+		return 0, fmt.Errorf("Unable to remove the expired versions of records in %s: %v", d.Name(), err)
+	}
+
+	return storage.DeleteRecords(d.Name(), filter)
+}
@@ -0,0 +1,140 @@
+package dataset
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// schemaCache holds the compiled schema for each DataSet, so that we don't
+// compile it again for every write. An entry is replaced when the schema
+// from the config API changes.
+type schemaCache struct {
+	sync.RWMutex
+	schemas map[string]cachedSchema
+}
+
+type cachedSchema struct {
+	hash       string
+	document   *gojsonschema.JsonSchemaDocument
+	properties map[string]schemaProperty
+}
+
+// schemaProperty is the type and format that a schema gives a field.
+type schemaProperty struct {
+	Type   string
+	Format string
+}
+
+var schemas = &schemaCache{schemas: make(map[string]cachedSchema)}
+
+// get returns the compiled form of the schema for the DataSet name.
+func (c *schemaCache) get(name string, schema json.RawMessage) (*cachedSchema, error) {
+	sum := sha256.Sum256(schema)
+	hash := hex.EncodeToString(sum[:])
+
+	c.RLock()
+	cached, ok := c.schemas[name]
+	c.RUnlock()
+
+	if ok && cached.hash == hash {
+		return &cached, nil
+	}
+
+	document, err := compileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	cached = cachedSchema{hash, document, schemaProperties(schema)}
+
+	c.Lock()
+	c.schemas[name] = cached
+	c.Unlock()
+
+	return &cached, nil
+}
+
+func compileSchema(schema json.RawMessage) (document *gojsonschema.JsonSchemaDocument, err error) {
+	// gojsonschema expects the numbers in a schema to be float64s, so this
+	// doesn't use utils.Unmarshal
+	var jsonDoc map[string]interface{}
+	if err = json.Unmarshal(schema, &jsonDoc); err != nil {
+		return nil, err
+	}
+
+	// gojsonschema panics on some invalid schemas rather than returning an error
+	defer func() {
+		if r := recover(); r != nil {
+			document, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	return gojsonschema.NewJsonSchemaDocument(jsonDoc)
+}
+
+// schemaProperties returns the type and format of each property that a schema
+// declares, either at the top level or in one of its allOf schemas. Properties
+// which may have more than one type, other than null, are left out.
+func schemaProperties(schema json.RawMessage) map[string]schemaProperty {
+	type propertiesSchema struct {
+		Properties map[string]struct {
+			Type   interface{} `json:"type"`
+			Format string      `json:"format"`
+		} `json:"properties"`
+	}
+
+	var holder struct {
+		propertiesSchema
+		AllOf []propertiesSchema `json:"allOf"`
+	}
+
+	properties := make(map[string]schemaProperty)
+	if err := json.Unmarshal(schema, &holder); err != nil {
+		return properties
+	}
+
+	for _, s := range append(holder.AllOf, holder.propertiesSchema) {
+		for name, property := range s.Properties {
+			if t := singleType(property.Type); t != "" {
+				properties[name] = schemaProperty{t, property.Format}
+			}
+		}
+	}
+
+	return properties
+}
+
+// SchemaTypes returns the type of each property that schema declares with a
+// single type, other than null, as schemaProperties finds them. Uploads use
+// it to coerce their cells in the same way as the records of a JSON upload.
+func SchemaTypes(schema json.RawMessage) map[string]string {
+	types := make(map[string]string)
+	for name, property := range schemaProperties(schema) {
+		types[name] = property.Type
+	}
+	return types
+}
+
+func singleType(schemaType interface{}) string {
+	switch t := schemaType.(type) {
+	case string:
+		return t
+	case []interface{}:
+		var result string
+		for _, v := range t {
+			if s, ok := v.(string); ok && s != "null" {
+				if result != "" {
+					return ""
+				}
+				result = s
+			}
+		}
+		return result
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package dataset
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alphagov/performance-datastore/pkg/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema cache", func() {
+	var cache *schemaCache
+
+	BeforeEach(func() {
+		cache = &schemaCache{schemas: make(map[string]cachedSchema)}
+	})
+
+	It("Should compile each schema once", func() {
+		schema := json.RawMessage(`{"type": "object"}`)
+
+		first, err := cache.get("the-dataset", schema)
+		Expect(err).Should(BeNil())
+		second, err := cache.get("the-dataset", schema)
+		Expect(err).Should(BeNil())
+
+		Expect(second.document).Should(BeIdenticalTo(first.document))
+	})
+
+	It("Should compile the schema again when it changes", func() {
+		first, _ := cache.get("the-dataset", json.RawMessage(`{"type": "object"}`))
+		second, err := cache.get("the-dataset", json.RawMessage(`{"type": "object", "required": ["a"]}`))
+
+		Expect(err).Should(BeNil())
+		Expect(second.document).ShouldNot(BeIdenticalTo(first.document))
+		Expect(cache.schemas).Should(HaveLen(1))
+	})
+
+	It("Should report invalid schemas instead of panicking", func() {
+		dataSet := DataSet{nil, config.DataSetMetaData{
+			Name:   "the-dataset",
+			Schema: json.RawMessage(`{"type": 12}`)}}
+		var errors []error
+
+		err := dataSet.ValidateAgainstSchema([]map[string]interface{}{{}}, &errors)
+
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.Error()).Should(HavePrefix("The schema for the-dataset is invalid: "))
+	})
+
+	It("Should report schemas which aren't JSON", func() {
+		dataSet := DataSet{nil, config.DataSetMetaData{
+			Name:   "the-dataset",
+			Schema: json.RawMessage(`{"type":`)}}
+		var errors []error
+
+		err := dataSet.ValidateAgainstSchema([]map[string]interface{}{{}}, &errors)
+
+		Expect(err).ShouldNot(BeNil())
+	})
+})
+
+// largeSchema returns a schema with n properties, like the larger schemas in
+// the config API.
+func largeSchema(n int) json.RawMessage {
+	properties := make([]string, n)
+	for i := range properties {
+		properties[i] = fmt.Sprintf(`"field_%d": {"type": "string", "maxLength": 100}`, i)
+	}
+	return json.RawMessage(`{"type": "object", "properties": {` + strings.Join(properties, ",") + `}}`)
+}
+
+func benchmarkSchemaValidation(b *testing.B, validate func(dataSet DataSet, records []map[string]interface{})) {
+	dataSet := DataSet{nil, config.DataSetMetaData{Name: "the-dataset", Schema: largeSchema(200)}}
+	records := []map[string]interface{}{{"field_1": "a", "field_2": "b"}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		validate(dataSet, records)
+	}
+}
+
+func BenchmarkSchemaValidationCompiledPerRequest(b *testing.B) {
+	benchmarkSchemaValidation(b, func(dataSet DataSet, records []map[string]interface{}) {
+		document, err := compileSchema(dataSet.MetaData.Schema)
+		if err != nil {
+			b.Fatal(err)
+		}
+		document.Validate(records[0])
+	})
+}
+
+func BenchmarkSchemaValidationCached(b *testing.B) {
+	benchmarkSchemaValidation(b, func(dataSet DataSet, records []map[string]interface{}) {
+		var errors []error
+		if err := dataSet.ValidateAgainstSchema(records, &errors); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+var _ = Describe("Type coercion", func() {
+	var (
+		dataSet DataSet
+		errors  []error
+	)
+
+	BeforeEach(func() {
+		dataSet = DataSet{nil, config.DataSetMetaData{
+			Name:        "coerced-dataset",
+			CoerceTypes: true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"count": {"type": "integer"},
+					"rate": {"type": ["number", "null"]},
+					"done": {"type": "boolean"},
+					"name": {"type": "string"}
+				},
+				"allOf": [{"properties": {"seen_at": {"type": "string", "format": "date-time"}}}]
+			}`)}}
+		errors = []error{}
+	})
+
+	It("Should convert strings to the types in the schema", func() {
+		records := []map[string]interface{}{
+			{"count": "12", "rate": " 0.5", "done": "true", "name": "12", "seen_at": "2014-01-01T00:00:00Z"}}
+
+		Expect(dataSet.CoerceTypes(records, &errors)).Should(BeNil())
+		Expect(dataSet.CoerceDateTimes(records, &errors)).Should(BeNil())
+
+		Expect(errors).Should(BeEmpty())
+		Expect(records[0]).Should(Equal(map[string]interface{}{
+			"count":   int64(12),
+			"rate":    0.5,
+			"done":    true,
+			"name":    "12",
+			"seen_at": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}))
+	})
+
+	It("Should report values which can't be converted", func() {
+		records := []map[string]interface{}{
+			{"count": 1.0},
+			{"count": "1.5", "done": "maybe", "seen_at": "yesterday"}}
+
+		dataSet.CoerceTypes(records, &errors)
+		dataSet.CoerceDateTimes(records, &errors)
+
+		Expect(errors).Should(Equal([]error{
+			&RecordError{1, "/1/count", UncoercibleValueCode, `count must be an integer but was "1.5"`},
+			&RecordError{1, "/1/done", UncoercibleValueCode, `done must be true or false but was "maybe"`},
+			&RecordError{1, "/1/seen_at", UncoercibleValueCode, `seen_at must be an ISO8601 date-time but was "yesterday"`}}))
+	})
+
+	It("Should leave values alone unless the DataSet asks for coercion", func() {
+		dataSet.MetaData.CoerceTypes = false
+		records := []map[string]interface{}{{"count": "12"}}
+
+		dataSet.CoerceTypes(records, &errors)
+
+		Expect(records[0]["count"]).Should(Equal("12"))
+	})
+})
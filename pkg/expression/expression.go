@@ -0,0 +1,330 @@
+// Package expression implements the small expression language used to
+// compute fields from the other fields of a record.
+//
+// Expressions are made of numbers, "strings", true, false, null, the names of
+// fields, the operators + - * / % == != < <= > >= && || ! and the functions
+// abs, min, max, round and coalesce. Fields which a record doesn't have are
+// null. There are no loops or assignments, so an expression always finishes.
+package expression
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// maxLength limits the size of an expression, which also limits how deeply
+// it can nest.
+const maxLength = 4096
+
+// Expression is a compiled expression, ready to be evaluated.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile parses source into an Expression.
+func Compile(source string) (*Expression, error) {
+	if len(source) > maxLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxLength)
+	}
+
+	p := &parser{lexer: newLexer(source)}
+	p.next()
+
+	root, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.token.kind != eofToken {
+		return nil, p.unexpected()
+	}
+
+	return &Expression{source, root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate returns the value of the expression for record. Numbers are
+// float64s, as they are when records are unmarshalled from JSON.
+func (e *Expression) Evaluate(record map[string]interface{}) (interface{}, error) {
+	return e.root.evaluate(record)
+}
+
+type node interface {
+	evaluate(record map[string]interface{}) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n literal) evaluate(record map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type field struct {
+	name string
+}
+
+func (n field) evaluate(record map[string]interface{}) (interface{}, error) {
+	value := record[n.name]
+	if i, ok := value.(int64); ok {
+		return float64(i), nil
+	}
+	return value, nil
+}
+
+type unary struct {
+	operator string
+	operand  node
+}
+
+func (n unary) evaluate(record map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.evaluate(record)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "-":
+		number, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %s", describe(value))
+		}
+		return -number, nil
+	default:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply ! to %s", describe(value))
+		}
+		return !b, nil
+	}
+}
+
+type binary struct {
+	operator    string
+	left, right node
+}
+
+func (n binary) evaluate(record map[string]interface{}) (interface{}, error) {
+	left, err := n.left.evaluate(record)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || don't evaluate their right hand side unless they need to
+	if n.operator == "&&" || n.operator == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %s to %s", n.operator, describe(left))
+		}
+		if l == (n.operator == "||") {
+			return l, nil
+		}
+
+		right, err := n.right.evaluate(record)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %s to %s", n.operator, describe(right))
+		}
+		return r, nil
+	}
+
+	right, err := n.right.evaluate(record)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n.operator, left, right)
+	case "+":
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", n.operator, describe(left), describe(right))
+	}
+
+	switch n.operator {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+func equal(left, right interface{}) bool {
+	if l, ok := left.(time.Time); ok {
+		r, ok := right.(time.Time)
+		return ok && l.Equal(r)
+	}
+	// objects and arrays can't be compared with ==
+	return reflect.DeepEqual(left, right)
+}
+
+func compare(operator string, left, right interface{}) (interface{}, error) {
+	var order int
+
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s with %s", describe(left), describe(right))
+		}
+		order = compareFloats(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s with %s", describe(left), describe(right))
+		}
+		order = compareStrings(l, r)
+	case time.Time:
+		r, ok := right.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s with %s", describe(left), describe(right))
+		}
+		order = compareFloats(float64(l.UnixNano()), float64(r.UnixNano()))
+	default:
+		return nil, fmt.Errorf("cannot compare %s with %s", describe(left), describe(right))
+	}
+
+	switch operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	default:
+		return order >= 0, nil
+	}
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(l, r string) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+type call struct {
+	name      string
+	arguments []node
+}
+
+// functions are the functions which expressions can call, with the number of
+// arguments they take. A negative number means at least that many.
+var functions = map[string]int{
+	"abs":      1,
+	"round":    2,
+	"min":      -1,
+	"max":      -1,
+	"coalesce": -1,
+}
+
+func (n call) evaluate(record map[string]interface{}) (interface{}, error) {
+	arguments := make([]interface{}, len(n.arguments))
+	for i, argument := range n.arguments {
+		value, err := argument.evaluate(record)
+		if err != nil {
+			return nil, err
+		}
+		arguments[i] = value
+	}
+
+	if n.name == "coalesce" {
+		for _, argument := range arguments {
+			if argument != nil {
+				return argument, nil
+			}
+		}
+		return nil, nil
+	}
+
+	numbers := make([]float64, len(arguments))
+	for i, argument := range arguments {
+		number, ok := argument.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s expects numbers but was given %s", n.name, describe(argument))
+		}
+		numbers[i] = number
+	}
+
+	switch n.name {
+	case "abs":
+		return math.Abs(numbers[0]), nil
+	case "round":
+		scale := math.Pow(10, math.Trunc(numbers[1]))
+		return math.Floor(numbers[0]*scale+0.5) / scale, nil
+	case "min":
+		result := numbers[0]
+		for _, number := range numbers[1:] {
+			result = math.Min(result, number)
+		}
+		return result, nil
+	default:
+		result := numbers[0]
+		for _, number := range numbers[1:] {
+			result = math.Max(result, number)
+		}
+		return result, nil
+	}
+}
+
+func describe(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,101 @@
+package expression
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func evaluate(source string, record map[string]interface{}) (interface{}, error) {
+	e, err := Compile(source)
+	Expect(err).Should(BeNil())
+	return e.Evaluate(record)
+}
+
+var _ = Describe("Expression", func() {
+	record := map[string]interface{}{
+		"completed":  3.0,
+		"started":    4.0,
+		"zero":       0.0,
+		"name":       "tax",
+		"device":     map[string]interface{}{"os": "android"},
+		"versions":   []interface{}{4.0, 4.4},
+		"_timestamp": time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	expectValues := func(cases map[string]interface{}) {
+		for source, expected := range cases {
+			value, err := evaluate(source, record)
+			Expect(err).Should(BeNil(), source)
+			Expect(value).Should(Equal(expected), source)
+		}
+	}
+
+	It("Should do arithmetic with the fields of a record", func() {
+		expectValues(map[string]interface{}{
+			"completed / started":                 0.75,
+			"completed + started * 2":             11.0,
+			"(completed + started) * 2":           14.0,
+			"-completed - -1":                     -2.0,
+			"started % completed":                 1.0,
+			"round(completed / started * 100, 0)": 75.0,
+			"round(2 / 3, 2)":                     0.67,
+			"abs(completed - started)":            1.0,
+			"min(completed, started, 10)":         3.0,
+			"max(completed, started, .5)":         4.0,
+		})
+	})
+
+	It("Should compare and combine values", func() {
+		expectValues(map[string]interface{}{
+			`name == "tax"`:                       true,
+			`name + "es"`:                         "taxes",
+			"completed < started && started <= 4": true,
+			"completed > started || !(zero != 0)": true,
+			"missing == null":                     true,
+			"coalesce(missing, name)":             "tax",
+			"_timestamp == _timestamp":            true,
+			"device == device":                    true,
+			"versions != device":                  true,
+			"versions == completed":               false,
+		})
+	})
+
+	It("Should not evaluate the right hand side of && and || unless it's needed", func() {
+		expectValues(map[string]interface{}{
+			"false && completed / zero": false,
+			"true || completed / zero":  true,
+		})
+	})
+
+	It("Should report errors evaluating the expression", func() {
+		_, err := evaluate("completed / zero", record)
+		Expect(err).Should(MatchError("division by zero"))
+
+		_, err = evaluate("completed / missing", record)
+		Expect(err).Should(MatchError("cannot apply / to 3 and null"))
+
+		_, err = evaluate("name < 1", record)
+		Expect(err).Should(MatchError(`cannot compare "tax" with 1`))
+
+		_, err = evaluate("abs(name)", record)
+		Expect(err).Should(MatchError(`abs expects numbers but was given "tax"`))
+	})
+
+	It("Should report syntax errors", func() {
+		for source, message := range map[string]string{
+			"completed /":       "unexpected end of expression",
+			"completed started": "unexpected started at position 11",
+			"(completed":        "unexpected end of expression",
+			"completed $ 1":     `unexpected '$' at position 11`,
+			`"unterminated`:     "unterminated string at position 1",
+			"sqrt(completed)":   "unknown function sqrt at position 1",
+			"round(completed)":  "wrong number of arguments to round at position 1",
+			"1.2.3":             "1.2.3 is not a number at position 1",
+		} {
+			_, err := Compile(source)
+			Expect(err).Should(MatchError(message), source)
+		}
+	})
+})
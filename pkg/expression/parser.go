@@ -0,0 +1,254 @@
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	numberToken
+	stringToken
+	identifierToken
+	operatorToken
+)
+
+type token struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+type lexer struct {
+	source   string
+	position int
+}
+
+func newLexer(source string) *lexer {
+	return &lexer{source: source}
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+func (l *lexer) next() (token, error) {
+	for l.position < len(l.source) && strings.ContainsRune(" \t\r\n", rune(l.source[l.position])) {
+		l.position++
+	}
+
+	start := l.position
+	if start == len(l.source) {
+		return token{eofToken, "", start}, nil
+	}
+
+	c := l.source[start]
+	switch {
+	case isDigit(c) || (c == '.' && start+1 < len(l.source) && isDigit(l.source[start+1])):
+		for l.position < len(l.source) && (isDigit(l.source[l.position]) || l.source[l.position] == '.') {
+			l.position++
+		}
+		return token{numberToken, l.source[start:l.position], start}, nil
+	case isLetter(c):
+		for l.position < len(l.source) && (isLetter(l.source[l.position]) || isDigit(l.source[l.position])) {
+			l.position++
+		}
+		return token{identifierToken, l.source[start:l.position], start}, nil
+	case c == '"':
+		l.position++
+		for l.position < len(l.source) && l.source[l.position] != '"' {
+			if l.source[l.position] == '\\' {
+				l.position++
+			}
+			l.position++
+		}
+		if l.position >= len(l.source) {
+			return token{}, fmt.Errorf("unterminated string at position %d", start+1)
+		}
+		l.position++
+		return token{stringToken, l.source[start:l.position], start}, nil
+	}
+
+	for _, operator := range operators {
+		if strings.HasPrefix(l.source[start:], operator) {
+			l.position += len(operator)
+			return token{operatorToken, operator, start}, nil
+		}
+	}
+
+	return token{}, fmt.Errorf("unexpected %q at position %d", c, start+1)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// precedence of the binary operators; higher binds more tightly.
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+type parser struct {
+	lexer *lexer
+	token token
+	err   error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.token, p.err = p.lexer.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.token.kind == eofToken {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %s at position %d", p.token.text, p.token.position+1)
+}
+
+func (p *parser) isOperator(text string) bool {
+	return p.err == nil && p.token.kind == operatorToken && p.token.text == text
+}
+
+// parseExpression parses binary operators which bind more tightly than
+// minPrecedence, by precedence climbing.
+func (p *parser) parseExpression(minPrecedence int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.err == nil && p.token.kind == operatorToken {
+		operator := p.token.text
+		prec, ok := precedence[operator]
+		if !ok || prec <= minPrecedence {
+			break
+		}
+		p.next()
+
+		right, err := p.parseExpression(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = binary{operator, left, right}
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOperator("-") || p.isOperator("!") {
+		operator := p.token.text
+		p.next()
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unary{operator, operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	t := p.token
+	switch t.kind {
+	case numberToken:
+		p.next()
+		number, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number at position %d", t.text, t.position+1)
+		}
+		return literal{number}, nil
+	case stringToken:
+		p.next()
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string at position %d", t.position+1)
+		}
+		return literal{s}, nil
+	case identifierToken:
+		p.next()
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		}
+		if p.isOperator("(") {
+			return p.parseCall(t)
+		}
+		return field{t.text}, nil
+	case operatorToken:
+		if t.text == "(" {
+			p.next()
+			inner, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOperator(")") {
+				return nil, p.unexpected()
+			}
+			p.next()
+			return inner, nil
+		}
+	}
+
+	return nil, p.unexpected()
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	arity, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at position %d", name.text, name.position+1)
+	}
+	p.next()
+
+	var arguments []node
+	for !p.isOperator(")") {
+		if len(arguments) > 0 {
+			if !p.isOperator(",") {
+				return nil, p.unexpected()
+			}
+			p.next()
+		}
+
+		argument, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		arguments = append(arguments, argument)
+	}
+	p.next()
+
+	if (arity >= 0 && len(arguments) != arity) || (arity < 0 && len(arguments) < -arity) {
+		return nil, fmt.Errorf("wrong number of arguments to %s at position %d", name.text, name.position+1)
+	}
+
+	return call{name.text, arguments}, nil
+}
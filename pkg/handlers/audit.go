@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/gorilla/mux"
+)
+
+// The actions which are audited.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditEmpty  = "empty"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records a request which changed, or tried to change, a DataSet.
+// Bearer tokens and request bodies are only recorded as SHA-256 hashes.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Action    string    `json:"action"`
+	DataSet   string    `json:"data_set"`
+	DataGroup string    `json:"data_group"`
+	DataType  string    `json:"data_type"`
+	TokenHash string    `json:"token_hash,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	// Records is the number of records in the request, or for streamed
+	// uploads and deletes, the number which were written or deleted.
+	Records  int    `json:"records"`
+	BodyHash string `json:"body_hash,omitempty"`
+	Status   int    `json:"status"`
+	Outcome  string `json:"outcome"`
+}
+
+// AuditStore defines the behaviour we need to keep an audit log.
+type AuditStore interface {
+	// Append adds an entry to the end of the log.
+	Append(entry AuditEntry) error
+	// Find returns the latest entries for the named DataSet, at most limit
+	// of them, newest first.
+	Find(dataSet string, limit int) ([]AuditEntry, error)
+}
+
+type fileAuditStore struct {
+	sync.Mutex
+	path string
+}
+
+// NewFileAuditStore returns an AuditStore which appends entries to the file at
+// path as lines of JSON, creating it if necessary. Entries are never changed
+// or removed.
+func NewFileAuditStore(path string) (AuditStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileAuditStore{path: path}, f.Close()
+}
+
+func (s *fileAuditStore) Append(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Find reads the whole log, which is fine for the occasional query. It
+// doesn't hold up Append, so a last line without a newline is still being
+// written and is skipped.
+func (s *fileAuditStore) Find(dataSet string, limit int) ([]AuditEntry, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var found []AuditEntry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("Unable to read the audit log: %v", err)
+		}
+		if entry.DataSet != dataSet {
+			continue
+		}
+
+		found = append(found, entry)
+		if len(found) > limit {
+			found = found[1:]
+		}
+	}
+
+	entries := []AuditEntry{}
+	for i := len(found) - 1; i >= 0; i-- {
+		entries = append(entries, found[i])
+	}
+	return entries, nil
+}
+
+// hashingReadCloser hashes everything read from a request body.
+type hashingReadCloser struct {
+	io.ReadCloser
+	hash hash.Hash
+	read int64
+}
+
+func (h *hashingReadCloser) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.hash.Write(p[:n])
+	h.read += int64(n)
+	return n, err
+}
+
+// audited wraps a handler which changes a DataSet so that each request is
+// recorded in the AuditLog. Handlers can change the action with
+// setAuditAction and report how many records were written with
+// setRecordCount. Handlers which only ran a dry run mark the request with
+// setDryRun, and it isn't recorded, since nothing was changed.
+// Requests which panic are recorded as failed before the panic carries on.
+func audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AuditLog == nil {
+			h(w, r)
+			return
+		}
+
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID, _ = newRandomID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		body := &hashingReadCloser{ReadCloser: r.Body, hash: sha256.New()}
+		r.Body = body
+		recorder := newStatusCapturingResponseWriter(w)
+
+		panicked := true
+		defer func() {
+			status := recorder.statusCode
+			if panicked {
+				status = http.StatusInternalServerError
+			} else if isDryRun(r) {
+				return
+			}
+			appendAuditEntry(r, action, requestID, body, status)
+		}()
+
+		h(recorder, r)
+		panicked = false
+	}
+}
+
+// appendAuditEntry records a request in the AuditLog. Only the part of the
+// body which the handler read is hashed.
+func appendAuditEntry(r *http.Request, action string, requestID string, body *hashingReadCloser, status int) {
+	params := mux.Vars(r)
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID,
+		Action:    action,
+		DataSet:   getDatasetName(r),
+		DataGroup: params["data_group"],
+		DataType:  params["data_type"],
+		TokenHash: hashBearerToken(r.Header.Get("Authorization")),
+		ClientIP:  clientIP(r),
+		Records:   getRecordCount(r),
+		Status:    status,
+		Outcome:   auditOutcome(status),
+	}
+	if override := getAuditAction(r); override != "" {
+		entry.Action = override
+	}
+	if body.read > 0 {
+		entry.BodyHash = hex.EncodeToString(body.hash.Sum(nil))
+	}
+
+	if err := AuditLog.Append(entry); err != nil {
+		StatsdClient.Incr("audit.error", 1)
+		getLogger(r).WithField("request_id", requestID).Errorf("Unable to write to the audit log: %v", err)
+	}
+}
+
+func hashBearerToken(authorization string) string {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(authorization, prefix) {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(authorization[len(prefix):]))
+	return hex.EncodeToString(hash[:])
+}
+
+// clientIP returns the address the request came from. Anyone can send an
+// X-Forwarded-For header, so it is read from the right, and each address is
+// only believed if it was added by one of the TrustedProxies.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		next := strings.TrimSpace(forwarded[i])
+		if next == "" {
+			break
+		}
+		ip = next
+	}
+
+	return ip
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxies := range TrustedProxies {
+		if proxies.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies reads a comma separated list of addresses and CIDR
+// blocks, like "10.0.0.0/8,192.0.2.1". An empty string trusts no proxies.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, block, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", value)
+		}
+		proxies = append(proxies, block)
+	}
+	return proxies, nil
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return "failed"
+	case status >= http.StatusBadRequest:
+		return "rejected"
+	default:
+		return "succeeded"
+	}
+}
+
+// AuditHandler lists the latest audit log entries for a DataSet, newest
+// first. It needs the DataSet's bearer token. At most limit entries are
+// returned, 100 by default.
+//
+// GET /_audit?data_set=:name&limit=:limit
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if AuditLog == nil {
+		renderError(w, http.StatusNotFound, "The audit log is not enabled")
+		return
+	}
+
+	args := r.URL.Query()
+	name := args.Get("data_set")
+	if name == "" {
+		renderError(w, http.StatusBadRequest, "Expected a data_set parameter")
+		return
+	}
+
+	limit, err := parseLimit(args, 100)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metaData, err := ConfigAPIClient.DataSet(name)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	dataSet := dataset.DataSet{DataSetStorage, *metaData}
+	if _, valid := extractBearerToken(dataSet, r.Header.Get("Authorization")); !valid {
+		w.Header().Add("WWW-Authenticate", "bearer")
+		renderError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: Invalid bearer token for '%s'", name))
+		return
+	}
+
+	entries, err := AuditLog.Find(name, limit)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "ok",
+		"entries": entries})
+}
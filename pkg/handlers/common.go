@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"mime"
+	"net"
 	"net/http"
 	"time"
 
@@ -10,6 +12,13 @@ import (
 	"gopkg.in/unrolled/render.v1"
 )
 
+// The media types of the request bodies that write requests accept, besides JSON.
+const (
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv"
+	xlsxContentType   = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
 // ErrorInfo is as described at jsonapi.org
 type ErrorInfo struct {
 	ID     string   `json:"id,omitempty"`
@@ -22,12 +31,28 @@ type ErrorInfo struct {
 	Path   string   `json:"path,omitempty"`
 }
 
+// ResponseMeta holds non-standard information about a response, as described at jsonapi.org
+type ResponseMeta struct {
+	Inserted int `json:"inserted,omitempty"`
+	Updated  int `json:"updated,omitempty"`
+	Deleted  int `json:"deleted,omitempty"`
+	// Processed is the number of records from a streamed upload that were
+	// written before the response.
+	Processed int `json:"processed,omitempty"`
+	// Journaled is the number of records that were accepted but will only be
+	// written once the database is available again.
+	Journaled int `json:"journaled,omitempty"`
+}
+
 // APIResponse is used for all JSON API responses.
 // See jsonapi.org/format/
 type APIResponse struct {
-	Status  string      `json:"status"`
-	Message string      `json:"message,omitempty"`
-	Errors  []ErrorInfo `json:"errors"`
+	Status  string                   `json:"status"`
+	Message string                   `json:"message,omitempty"`
+	Errors  []ErrorInfo              `json:"errors"`
+	Meta    *ResponseMeta            `json:"meta,omitempty"`
+	Data    []map[string]interface{} `json:"data,omitempty"`
+	Links   map[string]string        `json:"links,omitempty"`
 }
 
 var (
@@ -41,6 +66,33 @@ var (
 	// StatsdClient allows the statsd implementation to be injected for testing purposes
 	StatsdClient statsd.Statsd
 
+	// IdempotencyKeys remembers responses to write requests made with an
+	// Idempotency-Key header. Idempotency-Key headers are ignored if it is nil.
+	IdempotencyKeys IdempotencyStore
+
+	// WriteRateLimiter enforces RateLimits for each bearer token, and the
+	// rate limits in each DataSet's meta data. Nothing is limited if it is nil.
+	WriteRateLimiter *RateLimiter
+
+	// RateLimits limit the writes made with each bearer token.
+	RateLimits config.RateLimits
+
+	// DefaultDataSetRateLimits limit the writes to each DataSet which has no
+	// rate limits in its meta data.
+	DefaultDataSetRateLimits config.RateLimits
+
+	// Jobs queues the writes of requests with a Prefer: respond-async header.
+	// The header is ignored if it is nil.
+	Jobs *JobQueue
+
+	// AuditLog records every request which changes a DataSet. Nothing is
+	// recorded if it is nil.
+	AuditLog AuditStore
+
+	// TrustedProxies are the proxies whose X-Forwarded-For entries are
+	// believed when recording where a request came from.
+	TrustedProxies []*net.IPNet
+
 	renderer = render.New(render.Options{})
 )
 
@@ -51,16 +103,22 @@ func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderError(w http.ResponseWriter, status int, errorString ...string) {
-	errors := newErrorInfos(errorString...)
+	renderErrorInfos(w, status, newErrorInfos(errorString...))
+}
 
+func renderErrorInfos(w http.ResponseWriter, status int, errors []ErrorInfo) {
+	renderer.JSON(w, status, newErrorResponse(errors))
+}
+
+func newErrorResponse(errors []ErrorInfo) APIResponse {
 	var message string
 	if len(errors) == 1 {
-		message = errorString[0]
+		message = errors[0].Detail
 	}
-	renderer.JSON(w, status, APIResponse{
+	return APIResponse{
 		Status:  "error",
 		Message: message,
-		Errors:  errors})
+		Errors:  errors}
 }
 
 // NewStatsDClient returns a statsd.Statsd implementation
@@ -83,3 +141,10 @@ func newErrorInfos(errorString ...string) []ErrorInfo {
 	}
 	return errors
 }
+
+// hasMediaType reports whether the Content-Type of a request is mediaType,
+// ignoring any parameters such as the charset.
+func hasMediaType(r *http.Request, mediaType string) bool {
+	actual, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && actual == mediaType
+}
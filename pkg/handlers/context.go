@@ -4,12 +4,17 @@ import (
 	"net/http"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/alphagov/performance-datastore/pkg/dataset"
 	"github.com/gorilla/context"
 )
 
 const (
 	logKey         = 1 << iota // 1 (i.e. 1 << 0)
 	datasetNameKey             // 2 (i.e. 1 << 1)
+	recordCountKey             // 4 (i.e. 1 << 2)
+	auditActionKey             // 8 (i.e. 1 << 3)
+	dryRunKey                  // 16 (i.e. 1 << 4)
+	dataSetKey                 // 32 (i.e. 1 << 5)
 )
 
 // Type-safe application helpers to manage attributes on the request
@@ -18,11 +23,13 @@ func setLogger(r *http.Request, logger *logrus.Logger) {
 	context.Set(r, logKey, logger)
 }
 
+// getLogger returns the request's logger, or the standard logger if the
+// request didn't come through a LoggingHandler.
 func getLogger(r *http.Request) *logrus.Logger {
 	if rv := context.Get(r, logKey); rv != nil {
 		return rv.(*logrus.Logger)
 	}
-	return nil
+	return logrus.StandardLogger()
 }
 
 func setDatasetName(r *http.Request, name string) {
@@ -35,3 +42,42 @@ func getDatasetName(r *http.Request) string {
 	}
 	return ""
 }
+
+func setRecordCount(r *http.Request, count int) {
+	context.Set(r, recordCountKey, count)
+}
+
+func getRecordCount(r *http.Request) int {
+	if rv := context.Get(r, recordCountKey); rv != nil {
+		return rv.(int)
+	}
+	return 0
+}
+
+func setAuditAction(r *http.Request, action string) {
+	context.Set(r, auditActionKey, action)
+}
+
+func getAuditAction(r *http.Request) string {
+	if rv := context.Get(r, auditActionKey); rv != nil {
+		return rv.(string)
+	}
+	return ""
+}
+
+func setDryRun(r *http.Request) {
+	context.Set(r, dryRunKey, true)
+}
+
+func isDryRun(r *http.Request) bool {
+	return context.Get(r, dryRunKey) != nil
+}
+
+func setDataSet(r *http.Request, dataSet dataset.DataSet) {
+	context.Set(r, dataSetKey, dataSet)
+}
+
+func getDataSet(r *http.Request) (dataset.DataSet, bool) {
+	dataSet, ok := context.Get(r, dataSetKey).(dataset.DataSet)
+	return dataSet, ok
+}
@@ -1,12 +1,19 @@
 package handlers
 
 import (
+	"bufio"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 type gzipBombError struct{}
@@ -15,50 +22,163 @@ func (e gzipBombError) Error() string {
 	return fmt.Sprintf("Maximum upload size encountered. Treating as a potential zip bomb.")
 }
 
-type gzipReader struct {
-	body      io.ReadCloser       // underlying Request.Body
-	zr        io.Reader           // lazily-initialized gzip reader
-	maxSize   int                 // maximum size gzip request that we'll handle. Used to defend against zip bombs
-	readBytes int                 // the number bytes that have been read by this gzipReader
-	response  http.ResponseWriter // the context http.ResponseWriter
+// Decoder returns a reader which decodes a request body with a Content-Encoding.
+type Decoder func(r io.Reader) (io.Reader, error)
+
+var decoders = map[string]Decoder{
+	"identity": func(r io.Reader) (io.Reader, error) { return r, nil },
+	"gzip":     gzipDecoder,
+	"x-gzip":   gzipDecoder,
+	"deflate":  deflateDecoder,
+	"br":       brotliDecoder,
+	"zstd":     zstdDecoder,
+}
+
+// RegisterDecoder makes NewDecompressingHandler understand another Content-Encoding.
+func RegisterDecoder(encoding string, decoder Decoder) {
+	decoders[strings.ToLower(encoding)] = decoder
+}
+
+func gzipDecoder(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// deflateDecoder decodes zlib wrapped data, as HTTP defines deflate, but also
+// the raw deflate data which some clients send instead.
+func deflateDecoder(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	if (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+func brotliDecoder(r io.Reader) (io.Reader, error) {
+	return brotli.NewReader(r), nil
+}
+
+func zstdDecoder(r io.Reader) (io.Reader, error) {
+	// limit the window so that a small upload can't make us allocate a lot
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(64<<20))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// decodingReader lazily decodes a request body. Like each of the readers
+// beneath it, it stops with a gzipBombError once it has produced more than
+// maxSize bytes, to defend against zip bombs.
+type decodingReader struct {
+	body      io.Reader // the encoded body
+	decode    Decoder
+	dr        io.Reader // lazily-initialized decoding reader
+	maxSize   int       // maximum size of decoded body that we'll handle
+	readBytes int       // the number bytes that have been read by this decodingReader
 	logger    *logrus.Logger
 }
 
-func (gz *gzipReader) Read(p []byte) (n int, err error) {
-	if gz.zr == nil {
-		gz.zr, err = gzip.NewReader(gz.body)
+func (d *decodingReader) Read(p []byte) (n int, err error) {
+	if d.dr == nil {
+		d.dr, err = d.decode(d.body)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	n, err = gz.zr.Read(p)
+	n, err = d.dr.Read(p)
 
-	gz.readBytes += n
+	d.readBytes += n
 
-	if gz.readBytes > gz.maxSize {
-		gz.logger.Infof("Exceeded gzip decompression limit (%v) - aborting", gz.maxSize)
+	if d.readBytes > d.maxSize {
+		d.logger.Infof("Exceeded decompression limit (%v) - aborting", d.maxSize)
 		return n, &gzipBombError{}
 	}
 
 	return
 }
 
-func (gz *gzipReader) Close() error {
-	return gz.body.Close()
+// Close releases the decoding reader, and those it reads from.
+func (d *decodingReader) Close() error {
+	if closer, ok := d.dr.(io.Closer); ok {
+		closer.Close()
+	}
+	if inner, ok := d.body.(*decodingReader); ok {
+		inner.Close()
+	}
+	return nil
+}
+
+type decodedBody struct {
+	*decodingReader
+	body io.ReadCloser // underlying Request.Body
+}
+
+func (b *decodedBody) Close() error {
+	b.decodingReader.Close()
+	return b.body.Close()
+}
+
+// contentEncodings returns the encodings of a request in the order that
+// they were applied, ignoring identity.
+func contentEncodings(req *http.Request) (encodings []string) {
+	for _, header := range req.Header["Content-Encoding"] {
+		for _, encoding := range strings.Split(header, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return
+}
+
+func supportedEncodings() string {
+	var encodings []string
+	for encoding := range decoders {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+	return strings.Join(encodings, ", ")
 }
 
 // NewDecompressingHandler returns a http.Handler middleware which can decompress request bodies on the fly.
+// Bodies may have several encodings, which are decoded in reverse order. Requests with an
+// encoding that we don't understand get a 415 Unsupported Media Type response.
 func NewDecompressingHandler(h http.Handler, maxSize int) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		contentEncoding := req.Header["Content-Encoding"]
-		for _, v := range contentEncoding {
-			if v == "gzip" {
-				logger := getLogger(req)
-				logger.Debugln("Decompressing request")
-				req.Body = &gzipReader{body: req.Body, maxSize: maxSize, response: res, logger: logger}
+		encodings := contentEncodings(req)
+		if len(encodings) == 0 {
+			h.ServeHTTP(res, req)
+			return
+		}
+
+		for _, encoding := range encodings {
+			if _, ok := decoders[encoding]; !ok {
+				res.Header().Set("Accept-Encoding", supportedEncodings())
+				renderError(res, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Encoding: %s", encoding))
+				return
+			}
+		}
+
+		logger := getLogger(req)
+		logger.Debugf("Decompressing request with %v", encodings)
+
+		var body *decodingReader
+		for i := len(encodings) - 1; i >= 0; i-- {
+			var encoded io.Reader = req.Body
+			if body != nil {
+				encoded = body
 			}
+			body = &decodingReader{body: encoded, decode: decoders[encodings[i]], maxSize: maxSize, logger: logger}
 		}
+		req.Body = &decodedBody{body, req.Body}
 
 		h.ServeHTTP(res, req)
 	})
@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"encoding/gob"
+	"time"
+)
+
+// The journal and the job queue both keep records on disk with gob, which
+// needs to know the types which records hold in interface{} values.
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+}
@@ -1,17 +1,22 @@
 package handlers
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/alphagov/performance-datastore/pkg/config"
 	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/alphagov/performance-datastore/pkg/upload"
 	"github.com/alphagov/performance-datastore/pkg/utils"
+	"github.com/alphagov/performance-datastore/pkg/validation"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 )
@@ -21,11 +26,16 @@ import (
 // - the context request is JSON
 // - the request is correctly authorised
 // - the DataSet seems good
-type goodJSONContinuation func(jsonArray []interface{}, dataSet dataset.DataSet)
+type goodJSONContinuation func(w http.ResponseWriter, jsonArray []interface{}, dataSet dataset.DataSet)
+
+// xlsxMaxPartSize limits how much of each part of an Excel upload is
+// decompressed. NewHandler sets it to the limit on gzipped bodies.
+var xlsxMaxPartSize int64
 
 // NewHandler returns an http.Handler implementation for the server.
 func NewHandler(maxGzipBody int, logger *logrus.Logger) http.Handler {
 	router := mux.NewRouter()
+	xlsxMaxPartSize = int64(maxGzipBody)
 
 	// We wrap the http.Handler chain in a ClearHandler. We want the logger and
 	// things available for use in our other middleware
@@ -34,8 +44,16 @@ func NewHandler(maxGzipBody int, logger *logrus.Logger) http.Handler {
 	router.HandleFunc("/_status", StatusHandler).Methods("GET", "HEAD")
 	router.HandleFunc("/_status", MethodNotAllowedHandler)
 	router.HandleFunc("/_status/data-sets", DataSetStatusHandler).Methods("GET", "HEAD")
-	router.HandleFunc("/data/{data_group}/{data_type}", CreateHandler).Methods("POST")
-	router.HandleFunc("/data/{data_group}/{data_type}", UpdateHandler).Methods("PUT")
+	router.HandleFunc("/_status/retention", RetentionHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/_jobs/{id}", JobHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/_audit", AuditHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/data/{data_group}/{data_type}", ReadHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/data/{data_group}/{data_type}/{id}", ReadHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/data/{data_group}/{data_type}", audited(AuditCreate, rateLimited(CreateHandler))).Methods("POST")
+	router.HandleFunc("/data/{data_group}/{data_type}", audited(AuditUpdate, rateLimited(UpdateHandler))).Methods("PUT")
+	router.HandleFunc("/data/{data_group}/{data_type}/_validate", ValidateHandler).Methods("POST")
+	router.HandleFunc("/data/{data_group}/{data_type}", audited(AuditDelete, DeleteHandler)).Methods("DELETE")
+	router.HandleFunc("/data/{data_group}/{data_type}/{id}", audited(AuditDelete, DeleteHandler)).Methods("DELETE")
 
 	// Wrap up all our middleware
 	return context.ClearHandler(
@@ -45,50 +63,363 @@ func NewHandler(maxGzipBody int, logger *logrus.Logger) http.Handler {
 			logger))
 }
 
-// CreateHandler is responsible for creating data
+// CreateHandler is responsible for creating data. Requests with a
+// Content-Type of application/x-ndjson are streamed into the DataSet in batches.
+// Requests with a Prefer: respond-async header are queued and written in the
+// background, and the response links to the job for them.
 //
 // POST /data/:data_group/:data_type
 func CreateHandler(w http.ResponseWriter, r *http.Request) {
-	handleWriteRequest(w, r, func(jsonArray []interface{}, dataSet dataset.DataSet) {
-		errors := dataSet.Append(jsonArray)
+	if hasMediaType(r, ndjsonContentType) {
+		handleStreamingCreate(w, r)
+		return
+	}
 
-		if len(errors) > 0 {
-			errorMessages := make([]string, len(errors))
-			for i, e := range errors {
-				errorMessages[i] = e.Error()
-			}
-			renderError(w, http.StatusBadRequest, errorMessages...)
+	handleWriteRequest(w, r, func(w http.ResponseWriter, jsonArray []interface{}, dataSet dataset.DataSet) {
+		if !allowWrite(w, r, dataSet, 1, len(jsonArray), nil) {
+			return
+		}
+
+		if Jobs != nil && prefersAsync(r) {
+			enqueueWrite(w, r, jsonArray, dataSet)
+			return
+		}
+
+		result, err := dataSet.Append(jsonArray)
+
+		if err != nil {
+			renderWriteError(w, dataSet, err)
 		} else {
 			renderer.JSON(w, http.StatusOK, APIResponse{
-				Status: "ok"})
+				Status: "ok",
+				Meta:   newWriteMeta(result)})
 		}
 	})
 }
 
-// UpdateHandler is responsible for updating data
+// UpdateHandler is responsible for replacing all of the data in a DataSet
 //
 // PUT /data/:data_group/:data_type
 func UpdateHandler(w http.ResponseWriter, r *http.Request) {
-	handleWriteRequest(w, r, func(jsonArray []interface{}, dataSet dataset.DataSet) {
-		if len(jsonArray) > 0 {
-			renderError(w, http.StatusBadRequest, "Not implemented: you can only pass an empty JSON list")
+	handleWriteRequest(w, r, func(w http.ResponseWriter, jsonArray []interface{}, dataSet dataset.DataSet) {
+		if !allowWrite(w, r, dataSet, 1, len(jsonArray), nil) {
+			return
+		}
+
+		if len(jsonArray) == 0 {
+			setAuditAction(r, AuditEmpty)
+			if err := dataSet.Empty(); err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		} else if err := dataSet.Replace(jsonArray); err != nil {
+			renderWriteError(w, dataSet, err)
 			return
 		}
-		if err := dataSet.Empty(); err != nil {
-			renderError(w, http.StatusInternalServerError, err.Error())
+		renderer.JSON(w, http.StatusOK, APIResponse{
+			Status:  "ok",
+			Message: fmt.Sprintf("%s now contains %d records", dataSet.Name(), len(jsonArray))})
+	})
+}
+
+// ValidateHandler checks data as if it were being created, without storing it.
+// The response contains any errors and the records as they would have been stored.
+//
+// POST /data/:data_group/:data_type/_validate
+func ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	handleWriteRequest(w, r, func(w http.ResponseWriter, jsonArray []interface{}, dataSet dataset.DataSet) {
+		records, err := dataSet.Validate(jsonArray)
+
+		if errors, ok := err.(dataset.ValidationErrors); ok {
+			response := newErrorResponse(newValidationErrorInfos(errors))
+			response.Data = records
+			renderer.JSON(w, http.StatusBadRequest, response)
+			return
+		}
+
+		if err != nil {
+			renderWriteError(w, dataSet, err)
 			return
 		}
+
 		renderer.JSON(w, http.StatusOK, APIResponse{
 			Status:  "ok",
-			Message: dataSet.Name() + " now contains 0 records"})
+			Message: fmt.Sprintf("%d records are valid for %s", len(records), dataSet.Name()),
+			Data:    records})
 	})
 }
 
+// ReadHandler returns the records in a DataSet, either a single record by _id
+// or the records matching the filter_by, start_at and end_at parameters, at
+// most limit of them, 1000 by default. Passing as_of returns the records as
+// they were at that time, including the earlier versions of records in a
+// versioned DataSet. It needs the DataSet's bearer token.
+//
+// GET /data/:data_group/:data_type/:id?as_of=...
+// GET /data/:data_group/:data_type?filter_by=field:value&start_at=...&end_at=...&as_of=...&limit=...
+func ReadHandler(w http.ResponseWriter, r *http.Request) {
+	dataSet, ok := authorizedDataSet(w, r)
+	if !ok {
+		return
+	}
+
+	args := r.URL.Query()
+
+	filter, err := parseRecordFilter(mux.Vars(r)["id"], args)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := parseLimit(args, 1000)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, err := dataSet.Find(filter, limit)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if filter.ID != "" && len(records) == 0 {
+		renderError(w, http.StatusNotFound, fmt.Sprintf("No record with _id '%s' in '%s'", filter.ID, dataSet.Name()))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	renderer.JSON(w, http.StatusOK, APIResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Found %d records in %s", len(records), dataSet.Name()),
+		Data:    records})
+}
+
+// DeleteHandler is responsible for deleting data, either a single record by _id
+// or all of the records matching the filter_by, start_at and end_at parameters.
+// Passing dry_run=true reports how many records would be deleted without deleting them.
+//
+// DELETE /data/:data_group/:data_type/:id
+// DELETE /data/:data_group/:data_type?filter_by=field:value&start_at=...&end_at=...
+func DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	dataSet, ok := authorizedDataSet(w, r)
+	if !ok {
+		return
+	}
+
+	args := r.URL.Query()
+
+	dryRun, err := parseDryRun(args)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := newRecordFilter(mux.Vars(r)["id"], args)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only the current records can be deleted, so as_of can only be counted
+	if filter.AsOf != nil && !dryRun {
+		renderError(w, http.StatusBadRequest, "as_of can only be used with dry_run=true")
+		return
+	}
+
+	var count int
+	if dryRun {
+		count, err = dataSet.Count(filter)
+		setDryRun(r)
+	} else {
+		count, err = dataSet.Delete(filter)
+	}
+
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	setRecordCount(r, count)
+
+	if filter.ID != "" && count == 0 {
+		renderError(w, http.StatusNotFound, fmt.Sprintf("No record with _id '%s' in '%s'", filter.ID, dataSet.Name()))
+		return
+	}
+
+	message := fmt.Sprintf("Deleted %d records from %s", count, dataSet.Name())
+	if dryRun {
+		message = fmt.Sprintf("Would delete %d records from %s", count, dataSet.Name())
+	}
+
+	renderer.JSON(w, http.StatusOK, APIResponse{
+		Status:  "ok",
+		Message: message,
+		Meta:    &ResponseMeta{Deleted: count}})
+}
+
 func handleWriteRequest(
 	w http.ResponseWriter,
 	r *http.Request,
 	continuation goodJSONContinuation) {
 
+	dataSet, ok := authorizedDataSet(w, r)
+	if !ok {
+		return
+	}
+
+	jsonBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if gzerr, ok := err.(*gzipBombError); ok {
+			renderError(w, http.StatusRequestEntityTooLarge, gzerr.Error())
+		} else {
+			renderError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if len(jsonBytes) == 0 {
+		renderError(w, http.StatusBadRequest, "Expected JSON request body but received 0 bytes")
+		return
+	}
+
+	jsonArray, status, err := decodeRecords(r, dataSet, jsonBytes)
+	if errors, ok := err.(dataset.ValidationErrors); ok {
+		renderErrorInfos(w, status, newValidationErrorInfos(errors))
+		return
+	}
+	if err != nil {
+		renderError(w, status, err.Error())
+		return
+	}
+
+	setRecordCount(r, len(jsonArray))
+
+	withIdempotencyKey(w, r, dataSet.Name(), jsonBytes, func(w http.ResponseWriter) {
+		continuation(w, jsonArray, dataSet)
+	})
+}
+
+// decodeRecords converts a request body into records according to its
+// Content-Type. Bodies which aren't spreadsheets are expected to be JSON.
+// Spreadsheets are reshaped by the DataSet's upload filters. If the body
+// can't be decoded, the status to respond with is returned.
+func decodeRecords(r *http.Request, dataSet dataset.DataSet, body []byte) (records []interface{}, status int, err error) {
+	switch {
+	case hasMediaType(r, csvContentType):
+		if !acceptsUploadFormat(dataSet, "csv") {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("%s does not accept %s uploads", dataSet.Name(), csvContentType)
+		}
+
+		if records, err = upload.ParseCSV(bytes.NewReader(body), dataSet.MetaData.Schema); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Error parsing CSV: %v", err)
+		}
+
+		return applyUploadFilters(r, dataSet, records)
+	case hasMediaType(r, xlsxContentType):
+		if !acceptsUploadFormat(dataSet, "excel") {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("%s does not accept %s uploads", dataSet.Name(), xlsxContentType)
+		}
+
+		options, err := newXLSXOptions(r.URL.Query())
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		if records, err = upload.ParseXLSX(body, options, dataSet.MetaData.Schema); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Error parsing spreadsheet: %v", err)
+		}
+
+		return applyUploadFilters(r, dataSet, records)
+	default:
+		var data interface{}
+		if err = utils.Unmarshal(body, &data); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Error parsing JSON: %v", err)
+		}
+
+		records = ensureIsArray(data)
+	}
+
+	return records, http.StatusOK, nil
+}
+
+// applyUploadFilters runs the records from a spreadsheet through each of the
+// DataSet's upload filters in turn. Filters we don't have, such as backdrop's
+// contrib filters, are skipped with a warning. Records which a filter can't
+// reshape are reported as ValidationErrors.
+func applyUploadFilters(r *http.Request, dataSet dataset.DataSet, records []interface{}) ([]interface{}, int, error) {
+	filters, unknown, err := upload.NewFilters(dataSet.MetaData.UploadFilters)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Unable to apply the upload filters for %s: %v", dataSet.Name(), err)
+	}
+
+	for _, name := range unknown {
+		getLogger(r).Warnf("Skipping unknown upload filter '%s' for %s", name, dataSet.Name())
+	}
+
+	if len(filters) == 0 {
+		return records, http.StatusOK, nil
+	}
+
+	data := make([]map[string]interface{}, len(records))
+	for i, record := range records {
+		data[i] = record.(map[string]interface{})
+	}
+
+	for _, filter := range filters {
+		if data, err = filter(data); err != nil {
+			index, detail := 0, err.Error()
+			if filterErr, ok := err.(*upload.FilterError); ok {
+				index, detail = filterErr.Record, filterErr.Detail
+			}
+			return nil, http.StatusBadRequest, dataset.ValidationErrors{&dataset.RecordError{
+				Index:  index,
+				Path:   fmt.Sprintf("/%d", index),
+				Code:   dataset.UploadFilterCode,
+				Detail: detail}}
+		}
+	}
+
+	records = make([]interface{}, len(data))
+	for i, record := range data {
+		records[i] = record
+	}
+	return records, http.StatusOK, nil
+}
+
+func newXLSXOptions(args url.Values) (options upload.XLSXOptions, err error) {
+	options.Sheet = args.Get("sheet")
+	options.MaxPartSize = xlsxMaxPartSize
+
+	if headerRow := args.Get("header_row"); headerRow != "" {
+		options.HeaderRow, err = strconv.Atoi(headerRow)
+		if err != nil || options.HeaderRow < 1 {
+			err = fmt.Errorf("header_row must be a positive integer")
+		}
+	}
+
+	return
+}
+
+// acceptsUploadFormat reports whether a DataSet takes spreadsheet uploads in
+// format. DataSets without an upload format take CSV, as they did in backdrop.
+func acceptsUploadFormat(dataSet dataset.DataSet, format string) bool {
+	uploadFormat := dataSet.MetaData.UploadFormat
+	if uploadFormat == "" {
+		uploadFormat = "csv"
+	}
+	return uploadFormat == format
+}
+
+// authorizedDataSet looks up the DataSet for the request and checks that the
+// request is authorised to change it. If not, an error response is written
+// and false is returned.
+func authorizedDataSet(w http.ResponseWriter, r *http.Request) (dataSet dataset.DataSet, ok bool) {
+	// Middleware such as rateLimited may have already looked it up
+	if dataSet, ok = getDataSet(r); ok {
+		return
+	}
+
 	params := mux.Vars(r)
 
 	metaData, err := fetchDataMetaData(params["data_group"], params["data_type"])
@@ -97,7 +428,7 @@ func handleWriteRequest(
 		return
 	}
 
-	dataSet := dataset.DataSet{DataSetStorage, *metaData}
+	dataSet = dataset.DataSet{DataSetStorage, *metaData}
 
 	// Make the dataSet available to the request context
 	setDatasetName(r, dataSet.Name())
@@ -109,31 +440,133 @@ func handleWriteRequest(
 		return
 	}
 
-	jsonBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		if gzerr, ok := err.(*gzipBombError); ok {
-			renderError(w, http.StatusRequestEntityTooLarge, gzerr.Error())
+	setDataSet(r, dataSet)
+	return dataSet, true
+}
+
+// renderWriteError responds with a 400 listing the problems if the records
+// failed validation, otherwise with a 500 since the records couldn't be stored.
+func renderWriteError(w http.ResponseWriter, dataSet dataset.DataSet, err error) {
+	if errors, ok := err.(dataset.ValidationErrors); ok {
+		renderErrorInfos(w, http.StatusBadRequest, newValidationErrorInfos(errors))
+		return
+	}
+
+	StatsdClient.Incr("write.error."+dataSet.Name(), 1)
+	renderError(w, http.StatusInternalServerError, err.Error())
+}
+
+// newValidationErrorInfos describes each validation error, including where in
+// the request body the problem was if we know.
+func newValidationErrorInfos(errors []error) []ErrorInfo {
+	infos := make([]ErrorInfo, len(errors))
+	for i, e := range errors {
+		if recordErr, ok := e.(*dataset.RecordError); ok {
+			infos[i] = ErrorInfo{
+				Status: strconv.Itoa(http.StatusBadRequest),
+				Code:   recordErr.Code,
+				Detail: recordErr.Detail,
+				Path:   recordErr.Path}
 		} else {
-			renderError(w, http.StatusBadRequest, err.Error())
+			infos[i] = ErrorInfo{Detail: e.Error()}
 		}
+	}
+	return infos
+}
+
+func newWriteMeta(result dataset.WriteResult) *ResponseMeta {
+	return &ResponseMeta{Inserted: result.Inserted, Updated: result.Updated, Journaled: result.Journaled}
+}
+
+func parseDryRun(args url.Values) (bool, error) {
+	value := args.Get("dry_run")
+	if value == "" {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("dry_run must be true or false")
+	}
+	return dryRun, nil
+}
+
+// newRecordFilter builds the dataset.RecordFilter for a delete request. A request
+// without an id must be filtered, so that we never delete a whole DataSet by accident.
+func newRecordFilter(id string, args url.Values) (filter dataset.RecordFilter, err error) {
+	if filter, err = parseRecordFilter(id, args); err != nil {
 		return
 	}
 
-	if len(jsonBytes) == 0 {
-		renderError(w, http.StatusBadRequest, "Expected JSON request body but received 0 bytes")
+	if filter.ID == "" && filter.FilterBy == nil && filter.StartAt == nil && filter.EndAt == nil {
+		err = fmt.Errorf("Expected at least one of filter_by, start_at or end_at. Use PUT with an empty list to empty a data set")
+	}
+
+	return
+}
+
+// parseRecordFilter builds a dataset.RecordFilter from the id and the
+// filter_by, start_at, end_at and as_of parameters of a request.
+func parseRecordFilter(id string, args url.Values) (filter dataset.RecordFilter, err error) {
+	asOf, err := validation.NewDateTimeValidator("as_of").Validate(args)
+	if err != nil {
 		return
 	}
 
-	var data interface{}
-	err = utils.Unmarshal(jsonBytes, &data)
+	if asOf != nil {
+		filter.AsOf = asOf.(*time.Time)
+	}
+
+	if id != "" {
+		filter.ID = id
+		return
+	}
+
+	if _, err = validation.NewFilterByValidator().Validate(args); err != nil {
+		return
+	}
+
+	startAt, err := validation.NewDateTimeValidator("start_at").Validate(args)
+	if err != nil {
+		return
+	}
 
+	endAt, err := validation.NewDateTimeValidator("end_at").Validate(args)
 	if err != nil {
-		renderError(w, http.StatusBadRequest, "Error parsing JSON: "+err.Error())
 		return
 	}
 
-	jsonArray := ensureIsArray(data)
-	continuation(jsonArray, dataSet)
+	if startAt != nil {
+		filter.StartAt = startAt.(*time.Time)
+	}
+	if endAt != nil {
+		filter.EndAt = endAt.(*time.Time)
+	}
+
+	if filterBy, ok := args["filter_by"]; ok {
+		filter.FilterBy = make(map[string][]string)
+		for _, f := range filterBy {
+			parts := strings.SplitN(f, ":", 2)
+			filter.FilterBy[parts[0]] = append(filter.FilterBy[parts[0]], parts[1])
+		}
+	}
+
+	return
+}
+
+// parseLimit reads the limit parameter of a request, which must be a positive
+// integer, returning defaultLimit if there isn't one.
+func parseLimit(args url.Values, defaultLimit int) (int, error) {
+	value := args.Get("limit")
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+	return limit, nil
 }
 
 func ensureIsArray(data interface{}) []interface{} {
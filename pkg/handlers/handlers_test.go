@@ -2,15 +2,22 @@ package handlers
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/quipo/statsd"
 
 	"github.com/alphagov/performance-datastore/pkg/config"
@@ -31,32 +38,170 @@ type TestDataSetStorage struct {
 	lastUpdated *time.Time
 	exists      bool
 	error       error
+	savedIDs    map[interface{}]bool
+	saved       int
+	failOnSave  int
+	records     []map[string]interface{}
+	count       int
+	filter      dataset.RecordFilter
+	deleted     bool
+	retired     bool
+	versioned   bool
+	unversioned bool
+	unreachable bool
+}
+
+// connect fails like MongoDataSetStorage does when it can't connect.
+func (mock *TestDataSetStorage) connect() error {
+	if mock.unreachable {
+		return fmt.Errorf("Unable to connect: no reachable servers")
+	}
+	return nil
 }
 
 func (mock *TestDataSetStorage) Alive() bool {
-	return mock.alive
+	return mock.connect() == nil && mock.alive
 }
 
 func (mock *TestDataSetStorage) Create(name string, cappedSize int64) error {
+	if err := mock.connect(); err != nil {
+		return err
+	}
 	return mock.error
 }
 
 func (mock *TestDataSetStorage) Empty(name string) error {
+	if err := mock.connect(); err != nil {
+		return err
+	}
+	return mock.error
+}
+
+func (mock *TestDataSetStorage) Exists(name string) (bool, error) {
+	if err := mock.connect(); err != nil {
+		return false, err
+	}
+	return mock.exists, nil
+}
+
+func (mock *TestDataSetStorage) LastUpdated(name string) (*time.Time, error) {
+	if err := mock.connect(); err != nil {
+		return nil, err
+	}
+	return mock.lastUpdated, nil
+}
+
+func (mock *TestDataSetStorage) SaveRecords(name string, records []map[string]interface{}) (result dataset.WriteResult, err error) {
+	if err := mock.connect(); err != nil {
+		return result, err
+	}
+	if mock.error != nil {
+		return result, mock.error
+	}
+
+	if mock.failOnSave > 0 && mock.failOnSave <= len(records) {
+		return result, fmt.Errorf("Record %d could not be saved", mock.failOnSave)
+	}
+
+	if mock.savedIDs == nil {
+		mock.savedIDs = make(map[interface{}]bool)
+	}
+
+	for _, record := range records {
+		mock.saved++
+		mock.records = append(mock.records, record)
+		id, hasID := record["_id"]
+		if hasID && mock.savedIDs[id] {
+			result.Updated++
+		} else {
+			result.Inserted++
+		}
+		if hasID {
+			mock.savedIDs[id] = true
+		}
+	}
+
+	return result, nil
+}
+
+func (mock *TestDataSetStorage) Replace(name string, cappedSize int64, records []map[string]interface{}) error {
+	if err := mock.connect(); err != nil {
+		return err
+	}
 	return mock.error
 }
 
-func (mock *TestDataSetStorage) Exists(name string) bool {
-	return mock.exists
+func (mock *TestDataSetStorage) DeleteRecords(name string, filter dataset.RecordFilter) (int, error) {
+	if err := mock.connect(); err != nil {
+		return 0, err
+	}
+	mock.filter = filter
+	mock.deleted = true
+	return mock.count, mock.error
 }
 
-func (mock *TestDataSetStorage) LastUpdated(name string) *time.Time {
-	return mock.lastUpdated
+func (mock *TestDataSetStorage) SaveVersions(name string, records []map[string]interface{}, now time.Time) (dataset.WriteResult, error) {
+	mock.versioned = true
+	return mock.SaveRecords(name, records)
 }
 
-func (mock *TestDataSetStorage) SaveRecord(name string, record map[string]interface{}) error {
+func (mock *TestDataSetStorage) ReplaceVersions(name string, cappedSize int64, records []map[string]interface{}, now time.Time) error {
+	if err := mock.connect(); err != nil {
+		return err
+	}
+	mock.versioned = true
 	return mock.error
 }
 
+func (mock *TestDataSetStorage) RetireRecords(name string, filter dataset.RecordFilter, now time.Time) (int, error) {
+	if err := mock.connect(); err != nil {
+		return 0, err
+	}
+	mock.filter = filter
+	mock.retired = true
+	return mock.count, mock.error
+}
+
+func (mock *TestDataSetStorage) DeleteVersions(name string, filter dataset.RecordFilter) (int, error) {
+	if err := mock.connect(); err != nil {
+		return 0, err
+	}
+	mock.filter = filter
+	mock.unversioned = true
+	return mock.count, mock.error
+}
+
+func (mock *TestDataSetStorage) FindRecords(name string, filter dataset.RecordFilter, limit int) ([]map[string]interface{}, error) {
+	if err := mock.connect(); err != nil {
+		return nil, err
+	}
+	mock.filter = filter
+	records := mock.records
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, mock.error
+}
+
+func (mock *TestDataSetStorage) CountRecords(name string, filter dataset.RecordFilter) (int, error) {
+	mock.filter = filter
+	return mock.count, mock.error
+}
+
+// panickingStorage panics when saving or deleting records, as mgo can for
+// unexpected replies.
+type panickingStorage struct {
+	*TestDataSetStorage
+}
+
+func (p panickingStorage) SaveRecords(name string, records []map[string]interface{}) (dataset.WriteResult, error) {
+	panic("the storage failed")
+}
+
+func (p panickingStorage) DeleteRecords(name string, filter dataset.RecordFilter) (int, error) {
+	panic("the storage failed")
+}
+
 func (mock *TestDataSetStorage) options(opts ...TestDataSetStorageOption) (previous TestDataSetStorageOption) {
 	for _, opt := range opts {
 		previous = opt(mock)
@@ -90,6 +235,14 @@ func SomeError(err error) TestDataSetStorageOption {
 	}
 }
 
+func FailOnSave(n int) TestDataSetStorageOption {
+	return func(t *TestDataSetStorage) TestDataSetStorageOption {
+		previous := t.failOnSave
+		t.failOnSave = n
+		return FailOnSave(previous)
+	}
+}
+
 func LastUpdated(lastUpdated *time.Time) TestDataSetStorageOption {
 	return func(t *TestDataSetStorage) TestDataSetStorageOption {
 		previous := t.lastUpdated
@@ -98,6 +251,22 @@ func LastUpdated(lastUpdated *time.Time) TestDataSetStorageOption {
 	}
 }
 
+func Unreachable(unreachable bool) TestDataSetStorageOption {
+	return func(t *TestDataSetStorage) TestDataSetStorageOption {
+		previous := t.unreachable
+		t.unreachable = unreachable
+		return Unreachable(previous)
+	}
+}
+
+func RecordCount(count int) TestDataSetStorageOption {
+	return func(t *TestDataSetStorage) TestDataSetStorageOption {
+		previous := t.count
+		t.count = count
+		return RecordCount(previous)
+	}
+}
+
 func newTestDataSetStorage(options ...TestDataSetStorageOption) dataset.DataSetStorage {
 	result := TestDataSetStorage{}
 	result.options(options...)
@@ -283,6 +452,35 @@ var _ = Describe("Handlers", func() {
 			})
 		})
 
+		Context("with journaled writes", func() {
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "journal")
+				Expect(err).Should(BeNil())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("reports the depth of the journal", func() {
+				journal, err := NewJournaledStorage(dir, newTestDataSetStorage(Unreachable(true)), newJournalLogger())
+				Expect(err).Should(BeNil())
+				Expect(journal.Empty("the-dataset")).Should(BeNil())
+				DataSetStorage = journal
+
+				response, err := http.Get(testServer.URL + "/_status")
+				Expect(err).To(BeNil())
+				Expect(response.StatusCode).To(Equal(http.StatusInternalServerError))
+
+				status := Unmarshal(response.Body)
+				Expect(status["message"]).To(Equal("cannot connect to database"))
+				Expect(status["journal-depth"]).To(Equal(1.0))
+			})
+		})
+
 		Context("with unavailable storage", func() {
 			It("responds with a status of ruh roh when the storage is down", func() {
 				DataSetStorage = newTestDataSetStorage(Alive(false))
@@ -338,6 +536,25 @@ var _ = Describe("Handlers", func() {
 				Errors:  []ErrorInfo{ErrorInfo{Detail: "Unable to connect to host"}}}))
 		})
 
+		It("responds with a status of ruh roh when unable to talk to the database", func() {
+			testServer := testHandlerServer(DataSetStatusHandler)
+			defer testServer.Close()
+
+			DataSetStorage = newTestDataSetStorage(Unreachable(true))
+			ConfigAPIClient = newTestConfigAPIClient(
+				DataSets(
+					config.DataSetMetaData{},
+					config.DataSetMetaData{}))
+
+			response, err := http.Get(testServer.URL)
+			Expect(err).To(BeNil())
+			Expect(response.StatusCode).To(Equal(http.StatusInternalServerError))
+
+			Expect(response).To(EqualAPIResponse(APIResponse{Status: "error",
+				Message: "Unable to connect: no reachable servers",
+				Errors:  []ErrorInfo{ErrorInfo{Detail: "Unable to connect: no reachable servers"}}}))
+		})
+
 		It("responds with a status of OK when there are no stale datasets", func() {
 			testServer := testHandlerServer(DataSetStatusHandler)
 			defer testServer.Close()
@@ -545,7 +762,9 @@ var _ = Describe("Handlers", func() {
 				Expect(err).Should(BeNil())
 				Expect(response.StatusCode).Should(Equal(http.StatusOK))
 
-				Expect(response).Should(EqualAPIResponse(APIResponse{Status: "ok"}))
+				Expect(response).Should(EqualAPIResponse(APIResponse{
+					Status: "ok",
+					Meta:   &ResponseMeta{Inserted: 1}}))
 			})
 
 			It("Should persist the update for an array of objects", func() {
@@ -561,7 +780,49 @@ var _ = Describe("Handlers", func() {
 				Expect(err).Should(BeNil())
 				Expect(response.StatusCode).Should(Equal(http.StatusOK))
 
-				Expect(response).Should(EqualAPIResponse(APIResponse{Status: "ok"}))
+				Expect(response).Should(EqualAPIResponse(APIResponse{
+					Status: "ok",
+					Meta:   &ResponseMeta{Inserted: 2}}))
+			})
+
+			It("Should store integers without losing precision, and booleans", func() {
+				req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+					strings.NewReader(`{"animal":"parrot", "count":9007199254740993, "rate":0.5, "pining":true}`))
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+				response, err := client.Do(req)
+
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+				records := DataSetStorage.(*TestDataSetStorage).records
+				Expect(records).Should(HaveLen(1))
+				Expect(records[0]["count"]).Should(Equal(int64(9007199254740993)))
+				Expect(records[0]["rate"]).Should(Equal(0.5))
+				Expect(records[0]["pining"]).Should(Equal(true))
+			})
+
+			It("Should replace records which have the same _id", func() {
+				ConfigAPIClient = newTestConfigAPIClient(
+					MetaData(&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset",
+						AutoIds:     []string{"animal"}}))
+
+				for _, expected := range []ResponseMeta{ResponseMeta{Inserted: 1}, ResponseMeta{Updated: 1}} {
+					req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+						strings.NewReader(`{"animal":"parrot", "status":"pining"}`))
+					req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+					response, err := client.Do(req)
+
+					Expect(err).Should(BeNil())
+					Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+					Expect(response).Should(EqualAPIResponse(APIResponse{
+						Status: "ok",
+						Meta:   &expected}))
+				}
 			})
 
 			It("Should fail when provided with invalid data", func() {
@@ -574,7 +835,78 @@ var _ = Describe("Handlers", func() {
 				Expect(err).Should(BeNil())
 				Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
 
-				Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("_animal is not a recognised internal field")))
+				Expect(response).Should(EqualAPIResponse(APIResponse{
+					Status:  "error",
+					Message: "_animal is not a recognised internal field",
+					Errors: []ErrorInfo{
+						ErrorInfo{
+							Status: "400",
+							Code:   "unrecognised_internal_field",
+							Detail: "_animal is not a recognised internal field",
+							Path:   "/0/_animal"}}}))
+			})
+
+			It("Should report which records are invalid", func() {
+				req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+					strings.NewReader(`[
+	{"animal":"parrot", "status":"pining"},
+	{"animal":"fish", "_timestamp":"yesterday"},
+	{"animal":"fish", "status":{"slapping-fish":1}}
+]`))
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+				response, err := client.Do(req)
+
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+
+				Expect(response).Should(EqualAPIResponse(APIResponse{
+					Status: "error",
+					Errors: []ErrorInfo{
+						ErrorInfo{
+							Status: "400",
+							Code:   "invalid_timestamp",
+							Detail: "_timestamp is not a valid timestamp, it must be ISO8601",
+							Path:   "/1/_timestamp"},
+						ErrorInfo{
+							Status: "400",
+							Code:   "invalid_timestamp",
+							Detail: "_timestamp is not a valid datetime object",
+							Path:   "/1/_timestamp"},
+						ErrorInfo{
+							Status: "400",
+							Code:   "invalid_key",
+							Detail: "status.slapping-fish is not a valid key",
+							Path:   "/2/status/slapping-fish"}}}))
+			})
+
+			It("Should not persist any records when some of them are invalid", func() {
+				req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+					strings.NewReader(`[
+	{"animal":"parrot", "status":"pining"},
+	{"_animal":"fish", "status":"slapping"}
+]`))
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+				response, err := client.Do(req)
+
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+				Expect(DataSetStorage.(*TestDataSetStorage).saved).Should(Equal(0))
+			})
+
+			It("Should not save any records when one of them can't be saved", func() {
+				DataSetStorage = newTestDataSetStorage(Alive(true), Exists(true), FailOnSave(2))
+				req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+					strings.NewReader(`[{"_id":"parrot", "status":"pining"}, {"_id":"fish", "status":"slapping"}]`))
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+				response, err := client.Do(req)
+
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
+				Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Unable to save records to the-dataset: Record 2 could not be saved")))
+				Expect(DataSetStorage.(*TestDataSetStorage).savedIDs).Should(BeEmpty())
 			})
 
 			Context("With unavailable storage", func() {
@@ -591,14 +923,66 @@ var _ = Describe("Handlers", func() {
 					Expect(err).Should(BeNil())
 					Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
 
-					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Mongo connection is down")))
+					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Unable to save records to the-dataset: Mongo connection is down")))
 
-					// Check that the dataset was picked out of the context and the correct thing
-					// would have been sent to statsd
+					// Check that the correct thing would have been sent to statsd
 					testStatsd := StatsdClient.(*testStatsdClient)
 					Expect(testStatsd.incOps).Should(HaveLen(1))
 					Expect(testStatsd.incOps[0].stat).Should(Equal(`write.error.the-dataset`))
 				})
+
+				It("Should report failing to check whether the data set exists", func() {
+					DataSetStorage = newTestDataSetStorage(Unreachable(true))
+					StatsdClient = newTestStatsdClient()
+
+					req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+						strings.NewReader(`{"animal":"parrot", "status":"pining"}`))
+					req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+					response, err := client.Do(req)
+
+					Expect(err).Should(BeNil())
+					Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
+					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Unable to connect: no reachable servers")))
+				})
+			})
+
+			Context("With unreachable storage", func() {
+				var dir string
+
+				BeforeEach(func() {
+					var err error
+					dir, err = ioutil.TempDir("", "journal")
+					Expect(err).Should(BeNil())
+				})
+
+				AfterEach(func() {
+					os.RemoveAll(dir)
+				})
+
+				It("Should journal the records and write them once storage is back", func() {
+					storage := newTestDataSetStorage(Alive(true), Exists(true), Unreachable(true))
+					journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+					Expect(err).Should(BeNil())
+					DataSetStorage = journal
+
+					req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+						strings.NewReader(`[{"animal":"parrot", "status":"pining"}, {"animal":"dog", "status":"barking"}]`))
+					req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+					response, err := client.Do(req)
+
+					Expect(err).Should(BeNil())
+					Expect(response.StatusCode).Should(Equal(http.StatusOK))
+					Expect(response).Should(EqualAPIResponse(APIResponse{
+						Status: "ok",
+						Meta:   &ResponseMeta{Journaled: 2}}))
+					Expect(journal.Depth()).Should(Equal(2))
+
+					storage.(*TestDataSetStorage).unreachable = false
+					Expect(journal.Replay()).Should(Equal(0))
+					Expect(storage.(*TestDataSetStorage).saved).Should(Equal(2))
+				})
 			})
 
 			Context("With compressed requests", func() {
@@ -647,7 +1031,8 @@ var _ = Describe("Handlers", func() {
 					Expect(response.StatusCode).Should(Equal(http.StatusOK))
 
 					Expect(response).Should(EqualAPIResponse(APIResponse{
-						Status: "ok"}))
+						Status: "ok",
+						Meta:   &ResponseMeta{Inserted: 1}}))
 				})
 
 				It("Should fail if the request is too big", func() {
@@ -671,6 +1056,82 @@ var _ = Describe("Handlers", func() {
 
 					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Maximum upload size encountered. Treating as a potential zip bomb.")))
 				})
+
+				encode := func(encoding string, body []byte) []byte {
+					var b bytes.Buffer
+					var w io.WriteCloser
+					switch encoding {
+					case "gzip":
+						w = gzip.NewWriter(&b)
+					case "deflate":
+						w = zlib.NewWriter(&b)
+					case "br":
+						w = brotli.NewWriter(&b)
+					case "zstd":
+						w, _ = zstd.NewWriter(&b)
+					}
+					w.Write(body)
+					w.Close()
+					return b.Bytes()
+				}
+
+				post := func(contentEncoding string, body []byte) *http.Response {
+					req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+						bytes.NewReader(body))
+					req.Header.Add("Authorization", "Bearer the-bearer-token")
+					req.Header.Add("Content-Encoding", contentEncoding)
+
+					response, err := client.Do(req)
+					Expect(err).Should(BeNil())
+					return response
+				}
+
+				for _, encoding := range []string{"deflate", "br", "zstd"} {
+					encoding := encoding
+					It("Should succeed if the request has a Content-Encoding of "+encoding, func() {
+						response := post(encoding, encode(encoding, []byte(`{"animal":"parrot", "status":"pining"}`)))
+
+						Expect(response.StatusCode).Should(Equal(http.StatusOK))
+						Expect(response).Should(EqualAPIResponse(APIResponse{
+							Status: "ok",
+							Meta:   &ResponseMeta{Inserted: 1}}))
+					})
+				}
+
+				It("Should accept raw deflate data", func() {
+					var b bytes.Buffer
+					w, _ := flate.NewWriter(&b, flate.DefaultCompression)
+					w.Write([]byte(`{"animal":"parrot", "status":"pining"}`))
+					w.Close()
+
+					Expect(post("deflate", b.Bytes()).StatusCode).Should(Equal(http.StatusOK))
+				})
+
+				It("Should decode stacked encodings in reverse order", func() {
+					body := encode("br", encode("gzip", []byte(`{"animal":"parrot", "status":"pining"}`)))
+
+					response := post("gzip, br", body)
+
+					Expect(response.StatusCode).Should(Equal(http.StatusOK))
+				})
+
+				It("Should fail if the request has an unsupported Content-Encoding", func() {
+					response := post("compress", []byte(`{"animal":"parrot", "status":"pining"}`))
+
+					Expect(response.StatusCode).Should(Equal(http.StatusUnsupportedMediaType))
+					Expect(response.Header.Get("Accept-Encoding")).Should(Equal("br, deflate, gzip, identity, x-gzip, zstd"))
+					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Unsupported Content-Encoding: compress")))
+				})
+
+				It("Should fail if a zstd request is too big", func() {
+					testServer.Close()
+					handler := newHandler(10)
+					testServer = testHandlerServer(handler)
+
+					response := post("zstd", encode("zstd", []byte(`{"animal":"parrot", "status":"pining"}`)))
+
+					Expect(response.StatusCode).Should(Equal(http.StatusRequestEntityTooLarge))
+				})
 			})
 		})
 	})
@@ -807,10 +1268,28 @@ var _ = Describe("Handlers", func() {
 					Message: "the-dataset now contains 0 records"}))
 			})
 
-			It("Should fail to update if the array isn't empty", func() {
+			It("Should replace the data set with a non-empty array", func() {
+				req, err := http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type",
+					strings.NewReader(`[
+	{"animal":"parrot", "status":"pining"},
+	{"animal":"fish", "status":"slapping"}
+]`))
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+				response, err := client.Do(req)
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+				Expect(response).Should(EqualAPIResponse(APIResponse{
+					Status:  "ok",
+					Message: "the-dataset now contains 2 records"}))
+			})
+
+			It("Should fail to replace the data set when provided with invalid data", func() {
 				req, err := http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type",
 					strings.NewReader(`[
-	{"animal":"parrot", "status":"pining"}
+	{"animal":"parrot", "status":"pining"},
+	{"_animal":"fish", "status":"slapping"}
 ]`))
 				req.Header.Add("Authorization", "Bearer the-bearer-token")
 
@@ -818,7 +1297,15 @@ var _ = Describe("Handlers", func() {
 				Expect(err).Should(BeNil())
 				Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
 
-				Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Not implemented: you can only pass an empty JSON list")))
+				Expect(response).Should(EqualAPIResponse(APIResponse{
+					Status:  "error",
+					Message: "_animal is not a recognised internal field",
+					Errors: []ErrorInfo{
+						ErrorInfo{
+							Status: "400",
+							Code:   "unrecognised_internal_field",
+							Detail: "_animal is not a recognised internal field",
+							Path:   "/1/_animal"}}}))
 			})
 
 			Context("With unavailable storage", func() {
@@ -835,10 +1322,1781 @@ var _ = Describe("Handlers", func() {
 
 					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Mongo connection is down")))
 				})
+
+				It("Should propagate the error if there is a problem replacing the data set", func() {
+					DataSetStorage = newTestDataSetStorage(Alive(true), Exists(true), SomeError(fmt.Errorf("Mongo connection is down")))
+
+					req, err := http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type",
+						strings.NewReader(`[{"animal":"parrot", "status":"pining"}]`))
+					req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+					response, err := client.Do(req)
+					Expect(err).Should(BeNil())
+					Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
+
+					Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Unable to replace the records in the-dataset: Mongo connection is down")))
+				})
 			})
 
 		})
 	})
+
+	Describe("Validating data", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset",
+						AutoIds:     []string{"animal"}}))
+			DataSetStorage = newTestDataSetStorage(Alive(true), Exists(true))
+		})
+
+		AfterEach(func() {
+			defer testServer.Close()
+		})
+
+		It("Should fail with an Authorization required response when there is no Authorization header", func() {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type/_validate",
+				strings.NewReader(`{"animal":"parrot"}`))
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should return the transformed records without persisting them", func() {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type/_validate",
+				strings.NewReader(`{"animal":"parrot", "_timestamp":"2014-01-01T12:00:00Z"}`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "1 records are valid for the-dataset",
+				Data: []map[string]interface{}{
+					map[string]interface{}{
+						"_id":               "cGFycm90",
+						"animal":            "parrot",
+						"_timestamp":        "2014-01-01T12:00:00Z",
+						"_hour_start_at":    "2014-01-01T12:00:00Z",
+						"_day_start_at":     "2014-01-01T00:00:00Z",
+						"_week_start_at":    "2013-12-30T00:00:00Z",
+						"_month_start_at":   "2014-01-01T00:00:00Z",
+						"_quarter_start_at": "2014-01-01T00:00:00Z",
+						"_year_start_at":    "2014-01-01T00:00:00Z"}}}))
+			Expect(DataSetStorage.(*TestDataSetStorage).saved).Should(Equal(0))
+		})
+
+		It("Should return the errors along with the records", func() {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type/_validate",
+				strings.NewReader(`{"animal":"parrot", "_colour":"blue"}`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "_colour is not a recognised internal field",
+				Errors: []ErrorInfo{
+					ErrorInfo{
+						Status: "400",
+						Code:   "unrecognised_internal_field",
+						Detail: "_colour is not a recognised internal field",
+						Path:   "/0/_colour"}},
+				Data: []map[string]interface{}{
+					map[string]interface{}{
+						"_id":     "cGFycm90",
+						"animal":  "parrot",
+						"_colour": "blue"}}}))
+			Expect(DataSetStorage.(*TestDataSetStorage).saved).Should(Equal(0))
+		})
+	})
+
+	Describe("Deleting data", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset"}))
+			storage = newTestDataSetStorage(Alive(true), Exists(true), RecordCount(3)).(*TestDataSetStorage)
+			DataSetStorage = storage
+		})
+
+		AfterEach(func() {
+			defer testServer.Close()
+		})
+
+		It("Should fail with an Authorization required response when there is no Authorization header", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusUnauthorized))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Expected header of form: Authorization: Bearer token")))
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should delete a record by _id", func() {
+			storage.count = 1
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "Deleted 1 records from the-dataset",
+				Meta:    &ResponseMeta{Deleted: 1}}))
+			Expect(storage.filter).Should(Equal(dataset.RecordFilter{ID: "an-id"}))
+		})
+
+		It("Should respond with not found when there is no record with the _id", func() {
+			storage.count = 0
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusNotFound))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("No record with _id 'an-id' in 'the-dataset'")))
+		})
+
+		It("Should delete the records matching a filter", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?filter_by=animal:parrot&start_at=2014-01-01T00:00:00Z&end_at=2014-01-02T00:00:00Z", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "Deleted 3 records from the-dataset",
+				Meta:    &ResponseMeta{Deleted: 3}}))
+
+			startAt := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+			endAt := time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC)
+			Expect(storage.deleted).Should(BeTrue())
+			Expect(storage.filter.FilterBy).Should(Equal(map[string][]string{"animal": {"parrot"}}))
+			Expect(storage.filter.StartAt.Equal(startAt)).Should(BeTrue())
+			Expect(storage.filter.EndAt.Equal(endAt)).Should(BeTrue())
+		})
+
+		It("Should keep every value of a repeated filter_by", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?filter_by=tag:parrot&filter_by=tag:blue&filter_by=count:3", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.filter.FilterBy).Should(Equal(map[string][]string{"tag": {"parrot", "blue"}, "count": {"3"}}))
+		})
+
+		It("Should only count the matching records for a dry run", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?filter_by=animal:parrot&dry_run=true", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "Would delete 3 records from the-dataset",
+				Meta:    &ResponseMeta{Deleted: 3}}))
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should count the records as they were at a time for a dry run", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id?as_of=2015-03-31T12:00:00Z&dry_run=true", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.filter.ID).Should(Equal("an-id"))
+			Expect(storage.filter.AsOf.Equal(time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC))).Should(BeTrue())
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should refuse to delete records as they were at a time", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?filter_by=animal:parrot&as_of=2015-03-31T12:00:00Z", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("as_of can only be used with dry_run=true")))
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should refuse to delete without a filter", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Expected at least one of filter_by, start_at or end_at. Use PUT with an empty list to empty a data set")))
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should reject an invalid filter", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?filter_by=animal", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("filter_by is not a valid")))
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should propagate storage errors", func() {
+			storage.error = fmt.Errorf("Mongo connection is down")
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Mongo connection is down")))
+		})
+	})
+
+	Describe("Versioned data", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		BeforeEach(func() {
+			testServer = testHandlerServer(newHandler(10000000))
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset",
+						Versioned:   true}))
+			storage = newTestDataSetStorage(Alive(true), Exists(true), RecordCount(1)).(*TestDataSetStorage)
+			DataSetStorage = storage
+		})
+
+		AfterEach(func() {
+			testServer.Close()
+		})
+
+		It("Should keep the versions that records replace", func() {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type",
+				strings.NewReader(`{"_id":"parrot", "status":"pining"}`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.versioned).Should(BeTrue())
+			Expect(storage.records[0]["_valid_from"]).Should(BeAssignableToTypeOf(time.Time{}))
+		})
+
+		It("Should keep the records that are deleted", func() {
+			req, err := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "Deleted 1 records from the-dataset",
+				Meta:    &ResponseMeta{Deleted: 1}}))
+			Expect(storage.retired).Should(BeTrue())
+			Expect(storage.deleted).Should(BeFalse())
+			Expect(storage.filter).Should(Equal(dataset.RecordFilter{ID: "an-id"}))
+		})
+
+		It("Should keep the records it replaces without retiring them first", func() {
+			req, err := http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`[{"_id":"parrot"}]`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.versioned).Should(BeTrue())
+			Expect(storage.retired).Should(BeFalse())
+		})
+
+		It("Should read the records as they were at a time", func() {
+			storage.records = []map[string]interface{}{{"_id": "parrot", "status": "pining"}, {"_id": "dog"}}
+			req, err := http.NewRequest("GET", testServer.URL+"/data/a-data-group/a-data-type?as_of=2015-03-31T12:00:00Z&limit=1", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "Found 1 records in the-dataset",
+				Data:    []map[string]interface{}{{"_id": "parrot", "status": "pining"}}}))
+			Expect(storage.filter.AsOf.Equal(time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC))).Should(BeTrue())
+		})
+
+		It("Should need the data set's bearer token to read records", func() {
+			response, err := http.Get(testServer.URL + "/data/a-data-group/a-data-type")
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should not find a record which doesn't exist", func() {
+			req, err := http.NewRequest("GET", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusNotFound))
+			Expect(storage.filter).Should(Equal(dataset.RecordFilter{ID: "an-id"}))
+		})
+
+		It("Should keep the records when it is emptied", func() {
+			req, err := http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`[]`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+
+			response, err := client.Do(req)
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.retired).Should(BeTrue())
+			Expect(storage.filter).Should(Equal(dataset.RecordFilter{}))
+		})
+	})
+
+	Describe("Auditing", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var dir string
+
+		sha256Hex := func(s string) string {
+			hash := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(hash[:])
+		}
+
+		BeforeEach(func() {
+			testServer = testHandlerServer(newHandler(10000000))
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset"}))
+			DataSetStorage = newTestDataSetStorage(Alive(true), Exists(true), RecordCount(3))
+
+			var err error
+			dir, err = ioutil.TempDir("", "audit")
+			Expect(err).Should(BeNil())
+			AuditLog, err = NewFileAuditStore(dir + "/audit.log")
+			Expect(err).Should(BeNil())
+			TrustedProxies, err = ParseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+			Expect(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			AuditLog = nil
+			TrustedProxies = nil
+			os.RemoveAll(dir)
+			testServer.Close()
+		})
+
+		It("Should record who wrote what", func() {
+			body := `[{"animal":"parrot"}, {"animal":"dog"}]`
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(body))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("X-Request-Id", "a-request-id")
+			req.Header.Add("X-Forwarded-For", "192.0.2.1, 10.0.0.1")
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response.Header.Get("X-Request-Id")).Should(Equal("a-request-id"))
+
+			entries, err := AuditLog.Find("the-dataset", 10)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(1))
+
+			entry := entries[0]
+			entry.Time = time.Time{}
+			Expect(entry).Should(Equal(AuditEntry{
+				RequestID: "a-request-id",
+				Action:    AuditCreate,
+				DataSet:   "the-dataset",
+				DataGroup: "a-data-group",
+				DataType:  "a-data-type",
+				TokenHash: sha256Hex("the-bearer-token"),
+				ClientIP:  "192.0.2.1",
+				Records:   2,
+				BodyHash:  sha256Hex(body),
+				Status:    http.StatusOK,
+				Outcome:   "succeeded"}))
+		})
+
+		It("Should record rejected requests, but not dry runs", func() {
+			req, _ := http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?dry_run=true&filter_by=animal:parrot", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			client.Do(req)
+
+			req, _ = http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`[]`))
+			req.Header.Add("Authorization", "Bearer the-wrong-token")
+			client.Do(req)
+
+			entries, err := AuditLog.Find("the-dataset", 10)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Action).Should(Equal(AuditUpdate))
+			Expect(entries[0].Outcome).Should(Equal("rejected"))
+			Expect(entries[0].TokenHash).Should(Equal(sha256Hex("the-wrong-token")))
+			Expect(entries[0].BodyHash).Should(BeEmpty())
+			Expect(entries[0].RequestID).ShouldNot(BeEmpty())
+		})
+
+		It("Should record writes which ask for a dry run, since only deletes have them", func() {
+			req, _ := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type?dry_run=true", strings.NewReader(`[{"animal":"parrot"}]`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+			entries, err := AuditLog.Find("the-dataset", 10)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Action).Should(Equal(AuditCreate))
+			Expect(entries[0].Outcome).Should(Equal("succeeded"))
+		})
+
+		It("Should record requests which panic as failed", func() {
+			req, _ := http.NewRequest("POST", "/data/a-data-group/a-data-type", strings.NewReader(`[]`))
+			handler := audited(AuditCreate, func(w http.ResponseWriter, r *http.Request) {
+				panic("the handler failed")
+			})
+
+			Expect(func() { handler(httptest.NewRecorder(), req) }).Should(Panic())
+
+			entries, err := AuditLog.Find("", 10)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Status).Should(Equal(http.StatusInternalServerError))
+			Expect(entries[0].Outcome).Should(Equal("failed"))
+		})
+
+		It("Should only believe X-Forwarded-For entries added by trusted proxies", func() {
+			for forwarded, expected := range map[string]string{
+				"":                                   "10.1.1.1",
+				"192.0.2.1":                          "192.0.2.1",
+				"192.0.2.1, 10.0.0.1":                "192.0.2.1",
+				"203.0.113.9, 192.0.2.1, 10.0.0.1":   "192.0.2.1",
+				"203.0.113.9, 192.0.2.1, 127.0.0.1 ": "192.0.2.1"} {
+				req, _ := http.NewRequest("POST", "/data/a-data-group/a-data-type", nil)
+				req.RemoteAddr = "10.1.1.1:1234"
+				req.Header.Set("X-Forwarded-For", forwarded)
+				Expect(clientIP(req)).Should(Equal(expected))
+			}
+
+			req, _ := http.NewRequest("POST", "/data/a-data-group/a-data-type", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			Expect(clientIP(req)).Should(Equal("192.0.2.1"))
+		})
+
+		It("Should reject trusted proxies which aren't addresses", func() {
+			_, err := ParseTrustedProxies("10.0.0.0/8, a-proxy")
+			Expect(err).Should(MatchError(`invalid trusted proxy "a-proxy"`))
+		})
+
+		It("Should skip an entry which is still being written", func() {
+			f, err := os.OpenFile(dir+"/audit.log", os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).Should(BeNil())
+			f.WriteString(`{"data_set":"the-dataset","action":"create"}` + "\n" + `{"data_set":"the-da`)
+			f.Close()
+
+			entries, err := AuditLog.Find("the-dataset", 10)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Action).Should(Equal(AuditCreate))
+		})
+
+		It("Should list the latest entries for a data set", func() {
+			req, _ := http.NewRequest("PUT", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`[]`))
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			client.Do(req)
+
+			req, _ = http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type/an-id", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			client.Do(req)
+
+			req, _ = http.NewRequest("GET", testServer.URL+"/_audit?data_set=the-dataset", nil)
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+			var listing struct {
+				Status  string
+				Entries []AuditEntry
+			}
+			body, _ := ioutil.ReadAll(response.Body)
+			Expect(json.Unmarshal(body, &listing)).Should(BeNil())
+			Expect(listing.Entries).Should(HaveLen(2))
+			Expect(listing.Entries[0].Action).Should(Equal(AuditDelete))
+			Expect(listing.Entries[0].Records).Should(Equal(3))
+			Expect(listing.Entries[1].Action).Should(Equal(AuditEmpty))
+		})
+
+		It("Should need the data set's bearer token to list its entries", func() {
+			response, err := http.Get(testServer.URL + "/_audit?data_set=the-dataset")
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusUnauthorized))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Unauthorized: Invalid bearer token for 'the-dataset'")))
+		})
+
+		It("Should need a data set to list entries for", func() {
+			response, err := http.Get(testServer.URL + "/_audit")
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Expected a data_set parameter")))
+		})
+	})
+
+	Describe("Idempotent writes", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		post := func(key string, body string) *http.Response {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(body))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			if key != "" {
+				req.Header.Add("Idempotency-Key", key)
+			}
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			return response
+		}
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset"}))
+			storage = newTestDataSetStorage(Alive(true), Exists(true)).(*TestDataSetStorage)
+			DataSetStorage = storage
+			IdempotencyKeys = NewMemoryIdempotencyStore(time.Hour)
+		})
+
+		AfterEach(func() {
+			IdempotencyKeys = nil
+			defer testServer.Close()
+		})
+
+		It("Should write the data each time when there is no Idempotency-Key", func() {
+			Expect(post("", `[{"animal": "parrot"}]`).StatusCode).Should(Equal(http.StatusOK))
+			Expect(post("", `[{"animal": "parrot"}]`).StatusCode).Should(Equal(http.StatusOK))
+
+			Expect(storage.saved).Should(Equal(2))
+		})
+
+		It("Should replay the original response when a request is retried", func() {
+			first := post("a-key", `[{"animal": "parrot"}]`)
+			firstBody, _ := ioutil.ReadAll(first.Body)
+
+			second := post("a-key", `[{"animal": "parrot"}]`)
+			secondBody, _ := ioutil.ReadAll(second.Body)
+
+			Expect(second.StatusCode).Should(Equal(first.StatusCode))
+			Expect(secondBody).Should(Equal(firstBody))
+			Expect(second.Header.Get("Content-Type")).Should(Equal(first.Header.Get("Content-Type")))
+			Expect(second.Header.Get("Idempotent-Replayed")).Should(Equal("true"))
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should fail when an Idempotency-Key is used with a different body", func() {
+			post("a-key", `[{"animal": "parrot"}]`)
+
+			response := post("a-key", `[{"animal": "parakeet"}]`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusConflict))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Idempotency-Key 'a-key' has already been used for a different request")))
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should not remember responses to requests which failed with a server error", func() {
+			storage.error = fmt.Errorf("Mongo connection is down")
+			Expect(post("a-key", `[{"animal": "parrot"}]`).StatusCode).Should(Equal(http.StatusInternalServerError))
+
+			storage.error = nil
+			Expect(post("a-key", `[{"animal": "parrot"}]`).StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should keep Idempotency-Keys separate for each data set", func() {
+			post("a-key", `[{"animal": "parrot"}]`)
+
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "another-dataset"}))
+			response := post("a-key", `[{"animal": "parakeet"}]`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.saved).Should(Equal(2))
+		})
+
+		It("Should keep Idempotency-Keys separate for validating and writing", func() {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type/_validate", strings.NewReader(`[{"animal": "parrot"}]`))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Idempotency-Key", "a-key")
+			_, err = client.Do(req)
+			Expect(err).Should(BeNil())
+
+			response := post("a-key", `[{"animal": "parrot"}]`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response.Header.Get("Idempotent-Replayed")).Should(BeEmpty())
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should forget the Idempotency-Key when the request panics", func() {
+			req, _ := http.NewRequest("POST", "/data/a-data-group/a-data-type", nil)
+			req.Header.Add("Idempotency-Key", "a-key")
+
+			Expect(func() {
+				withIdempotencyKey(httptest.NewRecorder(), req, "the-dataset", nil, func(w http.ResponseWriter) {
+					panic("the handler failed")
+				})
+			}).Should(Panic())
+
+			called := false
+			withIdempotencyKey(httptest.NewRecorder(), req, "the-dataset", nil, func(w http.ResponseWriter) {
+				called = true
+			})
+			Expect(called).Should(BeTrue())
+		})
+	})
+
+	Describe("Retention", func() {
+		var storage *TestDataSetStorage
+		var logger *logrus.Logger
+
+		now := time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC)
+		cutoff := time.Date(2015, 3, 30, 12, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			ConfigAPIClient = newTestConfigAPIClient(
+				DataSets(
+					config.DataSetMetaData{Name: "forever"},
+					config.DataSetMetaData{Name: "daily", Retention: "1 day"}))
+			storage = newTestDataSetStorage(Alive(true), Exists(true), RecordCount(3)).(*TestDataSetStorage)
+			DataSetStorage = storage
+			StatsdClient = newTestStatsdClient()
+			logger = logrus.New()
+			logger.Level = logrus.WarnLevel
+			logger.Out = ioutil.Discard
+			retentionStatus.results = nil
+		})
+
+		It("Should delete the records older than the retention period", func() {
+			results, err := ExpireRecords(now, false, logger)
+
+			Expect(err).Should(BeNil())
+			Expect(results).Should(Equal([]RetentionResult{{Name: "daily", Retention: "1 day", Cutoff: cutoff, Expired: 3}}))
+			Expect(storage.deleted).Should(BeTrue())
+			Expect(storage.filter).Should(Equal(dataset.RecordFilter{EndAt: &cutoff}))
+			Expect(StatsdClient.(*testStatsdClient).incOps).Should(Equal([]incOperation{{"retention.expired.daily", 3}}))
+		})
+
+		It("Should delete expired records and their expired versions from versioned data sets", func() {
+			ConfigAPIClient = newTestConfigAPIClient(
+				DataSets(config.DataSetMetaData{Name: "daily", Retention: "1 day", Versioned: true}))
+
+			results, err := ExpireRecords(now, false, logger)
+
+			Expect(err).Should(BeNil())
+			Expect(results).Should(Equal([]RetentionResult{{Name: "daily", Retention: "1 day", Cutoff: cutoff, Expired: 3}}))
+			Expect(storage.unversioned).Should(BeTrue())
+			Expect(storage.deleted).Should(BeTrue())
+			Expect(storage.retired).Should(BeFalse())
+			Expect(storage.filter).Should(Equal(dataset.RecordFilter{EndAt: &cutoff}))
+		})
+
+		It("Should only count the records in a dry run", func() {
+			results, err := ExpireRecords(now, true, logger)
+
+			Expect(err).Should(BeNil())
+			Expect(results).Should(Equal([]RetentionResult{{Name: "daily", Retention: "1 day", Cutoff: cutoff, Expired: 3}}))
+			Expect(storage.deleted).Should(BeFalse())
+			Expect(StatsdClient.(*testStatsdClient).incOps).Should(BeEmpty())
+		})
+
+		It("Should carry on past data sets which can't be expired", func() {
+			ConfigAPIClient = newTestConfigAPIClient(
+				DataSets(
+					config.DataSetMetaData{Name: "broken", Retention: "forever"},
+					config.DataSetMetaData{Name: "daily", Retention: "1 day"}))
+
+			results, err := ExpireRecords(now, false, logger)
+
+			Expect(err).Should(BeNil())
+			Expect(results).Should(Equal([]RetentionResult{
+				{Name: "broken", Retention: "forever", Error: `The retention period for broken is invalid: "forever"`},
+				{Name: "daily", Retention: "1 day", Cutoff: cutoff, Expired: 3}}))
+			Expect(StatsdClient.(*testStatsdClient).incOps).Should(Equal([]incOperation{
+				{"retention.error.broken", 1},
+				{"retention.expired.daily", 3}}))
+		})
+
+		It("Should report what would be expired without deleting anything", func() {
+			testServer := testHandlerServer(newHandler(10000000))
+			defer testServer.Close()
+
+			response, err := http.Get(testServer.URL + "/_status/retention")
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			body := Unmarshal(response.Body)
+			Expect(body["status"]).Should(Equal("ok"))
+			Expect(body["data-sets"]).Should(HaveLen(1))
+			Expect(body["data-sets"].([]interface{})[0]).Should(HaveKeyWithValue("expired", 3.0))
+			Expect(storage.deleted).Should(BeFalse())
+		})
+
+		It("Should reuse recent counts", func() {
+			testServer := testHandlerServer(newHandler(10000000))
+			defer testServer.Close()
+
+			_, err := http.Get(testServer.URL + "/_status/retention")
+			Expect(err).Should(BeNil())
+			storage.count = 5
+			response, err := http.Get(testServer.URL + "/_status/retention")
+			Expect(err).Should(BeNil())
+			Expect(Unmarshal(response.Body)["data-sets"].([]interface{})[0]).Should(HaveKeyWithValue("expired", 3.0))
+
+			retentionStatus.at = time.Now().Add(-RetentionStatusMaxAge)
+			response, err = http.Get(testServer.URL + "/_status/retention")
+			Expect(err).Should(BeNil())
+			Expect(Unmarshal(response.Body)["data-sets"].([]interface{})[0]).Should(HaveKeyWithValue("expired", 5.0))
+		})
+
+		It("Should keep reaping after a panic", func() {
+			DataSetStorage = panickingStorage{storage}
+
+			Expect(func() { reapExpiredRecords(logger) }).ShouldNot(Panic())
+			Expect(StatsdClient.(*testStatsdClient).incOps).Should(Equal([]incOperation{{"retention.panic", 1}}))
+		})
+	})
+
+	Describe("Rate limiting", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		post := func(contentType string, body string) *http.Response {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(body))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Content-Type", contentType)
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			return response
+		}
+
+		withRateLimits := func(limits *config.RateLimits) {
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset",
+						RateLimits:  limits}))
+		}
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			withRateLimits(nil)
+			storage = newTestDataSetStorage(Alive(true), Exists(true)).(*TestDataSetStorage)
+			DataSetStorage = storage
+			WriteRateLimiter = NewRateLimiter()
+		})
+
+		AfterEach(func() {
+			WriteRateLimiter = nil
+			RateLimits = config.RateLimits{}
+			DefaultDataSetRateLimits = config.RateLimits{}
+			NDJSONBatchSize = 1000
+			defer testServer.Close()
+		})
+
+		It("Should limit the requests to a data set", func() {
+			withRateLimits(&config.RateLimits{Requests: config.RateLimit{PerSecond: 0.5, Burst: 1}})
+
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+			response := post("application/json", `{"animal": "parrot"}`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			Expect(response.Header.Get("Retry-After")).Should(Equal("2"))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Too many requests written to the-dataset, retry after 2 seconds")))
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should limit the requests before reading the body", func() {
+			withRateLimits(&config.RateLimits{Requests: config.RateLimit{PerSecond: 0.5, Burst: 1}})
+
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+			Expect(post("application/json", `not json`).StatusCode).Should(Equal(http.StatusTooManyRequests))
+		})
+
+		It("Should limit data sets without rate limits to the default", func() {
+			DefaultDataSetRateLimits = config.RateLimits{Requests: config.RateLimit{PerSecond: 0.5, Burst: 1}}
+
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+			response := post("application/json", `{"animal": "parrot"}`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Too many requests written to the-dataset, retry after 2 seconds")))
+		})
+
+		It("Should not use up a request when there are too many records", func() {
+			RateLimits = config.RateLimits{Requests: config.RateLimit{PerSecond: 0.5, Burst: 2}}
+			withRateLimits(&config.RateLimits{Records: config.RateLimit{PerSecond: 0.1, Burst: 1}})
+
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+			response := post("application/json", `{"animal": "fish"}`)
+			Expect(response.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Too many records written to the-dataset, retry after 10 seconds")))
+
+			withRateLimits(nil)
+			Expect(post("application/json", `{"animal": "fish"}`).StatusCode).Should(Equal(http.StatusOK))
+		})
+
+		It("Should not limit validating or deleting records", func() {
+			withRateLimits(&config.RateLimits{
+				Requests: config.RateLimit{PerSecond: 0.5, Burst: 1},
+				Records:  config.RateLimit{PerSecond: 0.5, Burst: 1}})
+
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type/_validate", strings.NewReader(`[{"animal": "parrot"}, {"animal": "fish"}]`))
+				Expect(err).Should(BeNil())
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+				response, err := client.Do(req)
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+				req, err = http.NewRequest("DELETE", testServer.URL+"/data/a-data-group/a-data-type?dry_run=true&filter_by=animal:parrot", nil)
+				Expect(err).Should(BeNil())
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+				response, err = client.Do(req)
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			}
+
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+		})
+
+		It("Should not limit replayed requests", func() {
+			IdempotencyKeys = NewMemoryIdempotencyStore(time.Hour)
+			defer func() { IdempotencyKeys = nil }()
+			withRateLimits(&config.RateLimits{Records: config.RateLimit{PerSecond: 0.1, Burst: 1}})
+
+			postWithKey := func() *http.Response {
+				req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`{"animal": "parrot"}`))
+				Expect(err).Should(BeNil())
+				req.Header.Add("Authorization", "Bearer the-bearer-token")
+				req.Header.Add("Idempotency-Key", "the-key")
+				response, err := client.Do(req)
+				Expect(err).Should(BeNil())
+				return response
+			}
+
+			Expect(postWithKey().StatusCode).Should(Equal(http.StatusOK))
+			response := postWithKey()
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response.Header.Get("Idempotent-Replayed")).Should(Equal("true"))
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should not keep the Idempotency-Key of a rate limited request", func() {
+			IdempotencyKeys = NewMemoryIdempotencyStore(time.Hour)
+			defer func() { IdempotencyKeys = nil }()
+			withRateLimits(&config.RateLimits{Records: config.RateLimit{PerSecond: 0.1, Burst: 1}})
+			Expect(post("application/json", `{"animal": "fish"}`).StatusCode).Should(Equal(http.StatusOK))
+
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`{"animal": "parrot"}`))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Idempotency-Key", "the-key")
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+
+			Expect(response.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			previous, ok := IdempotencyKeys.Start("the-dataset\n/data/a-data-group/a-data-type\nthe-key", "another-hash")
+			Expect(ok).Should(BeTrue())
+			Expect(previous).Should(BeNil())
+		})
+
+		It("Should limit the requests made with a bearer token", func() {
+			RateLimits = config.RateLimits{Requests: config.RateLimit{PerSecond: 0.5, Burst: 2}}
+
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusOK))
+			Expect(post("application/json", `{"animal": "parrot"}`).StatusCode).Should(Equal(http.StatusTooManyRequests))
+		})
+
+		It("Should limit the records written to a data set", func() {
+			withRateLimits(&config.RateLimits{Records: config.RateLimit{PerSecond: 1, Burst: 2}})
+
+			Expect(post("application/json", `[{"animal": "parrot"}, {"animal": "fish"}, {"animal": "cat"}]`).StatusCode).Should(Equal(http.StatusOK))
+			response := post("application/json", `{"animal": "parrot"}`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			Expect(response.Header.Get("Retry-After")).Should(Equal("2"))
+			Expect(storage.saved).Should(Equal(3))
+		})
+
+		It("Should stop a stream when it reaches the record limit", func() {
+			withRateLimits(&config.RateLimits{Records: config.RateLimit{PerSecond: 0.1, Burst: 2}})
+			NDJSONBatchSize = 2
+
+			response := post("application/x-ndjson", "{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n{\"_id\": \"c\"}")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			Expect(response.Header.Get("Retry-After")).Should(Equal("10"))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "Too many records written to the-dataset, retry after 10 seconds",
+				Errors:  []ErrorInfo{{Detail: "Too many records written to the-dataset, retry after 10 seconds"}},
+				Meta:    &ResponseMeta{Inserted: 2, Processed: 2}}))
+			Expect(storage.saved).Should(Equal(2))
+		})
+	})
+
+	Describe("Asynchronous writes", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+		var dir string
+		var stop chan struct{}
+
+		post := func(body string) *http.Response {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(body))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Prefer", "respond-async, wait=10")
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			return response
+		}
+
+		finishedJob := func(location string) (job Job) {
+			Eventually(func() bool {
+				response, err := http.Get(testServer.URL + location)
+				Expect(err).Should(BeNil())
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+				job = Job{}
+				Expect(json.NewDecoder(response.Body).Decode(&job)).Should(BeNil())
+				return job.finished()
+			}).Should(BeTrue())
+			return
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "jobs")
+			Expect(err).Should(BeNil())
+			Jobs, err = NewJobQueue(dir, time.Hour)
+			Expect(err).Should(BeNil())
+			stop = make(chan struct{})
+			go Jobs.Run(logrus.New(), stop)
+
+			testServer = testHandlerServer(newHandler(10000000))
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset"}))
+			storage = newTestDataSetStorage(Alive(true), Exists(true)).(*TestDataSetStorage)
+			DataSetStorage = storage
+		})
+
+		AfterEach(func() {
+			close(stop)
+			Jobs = nil
+			os.RemoveAll(dir)
+			testServer.Close()
+		})
+
+		It("Should queue the records and write them in the background", func() {
+			response := post(`[{"_id": "a"}, {"_id": "b"}, {"_id": "a"}]`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusAccepted))
+			location := response.Header.Get("Location")
+			Expect(location).Should(HavePrefix("/_jobs/"))
+			Expect(response.Header.Get("Preference-Applied")).Should(Equal("respond-async"))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "accepted",
+				Message: "Queued 3 records for the-dataset",
+				Links:   map[string]string{"job": location}}))
+
+			job := finishedJob(location)
+			Expect(job.Status).Should(Equal(JobSucceeded))
+			Expect(job.Total).Should(Equal(3))
+			Expect(job.Processed).Should(Equal(3))
+			Expect(job.Inserted).Should(Equal(2))
+			Expect(job.Updated).Should(Equal(1))
+			Expect(storage.saved).Should(Equal(3))
+		})
+
+		It("Should report the records which are invalid", func() {
+			response := post(`[{"_id": "a"}, {"_id": "b"}, {"_id": "c"}, {"_foo": "d"}]`)
+			Expect(response.StatusCode).Should(Equal(http.StatusAccepted))
+
+			job := finishedJob(response.Header.Get("Location"))
+			Expect(job.Status).Should(Equal(JobFailed))
+			Expect(job.Processed).Should(Equal(0))
+			Expect(job.Errors).Should(Equal([]ErrorInfo{{
+				Status: "400",
+				Code:   "unrecognised_internal_field",
+				Detail: "_foo is not a recognised internal field",
+				Path:   "/3/_foo"}}))
+			Expect(storage.saved).Should(Equal(0))
+		})
+
+		It("Should fail a job which panics and carry on with the next", func() {
+			DataSetStorage = panickingStorage{storage}
+			job := finishedJob(post(`[{"_id": "a"}]`).Header.Get("Location"))
+			Expect(job.Status).Should(Equal(JobFailed))
+			Expect(job.Errors).Should(Equal([]ErrorInfo{{Detail: "the storage failed"}}))
+
+			DataSetStorage = storage
+			job = finishedJob(post(`[{"_id": "b"}]`).Header.Get("Location"))
+			Expect(job.Status).Should(Equal(JobSucceeded))
+		})
+
+		It("Should reject records which aren't objects before queueing them", func() {
+			response := post(`[{"_id": "a"}, 1]`)
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Expected record 1 to be a JSON object")))
+		})
+
+		It("Should respond with not found for unknown jobs", func() {
+			response, err := http.Get(testServer.URL + "/_jobs/unknown")
+
+			Expect(err).Should(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Uploading CSV", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		post := func(body string) *http.Response {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(body))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Content-Type", "text/csv; charset=utf-8")
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			return response
+		}
+
+		withUploadFormat := func(format string) {
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken:  "the-bearer-token",
+						Name:         "the-dataset",
+						UploadFormat: format}))
+		}
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			withUploadFormat("")
+			storage = newTestDataSetStorage(Alive(true), Exists(true)).(*TestDataSetStorage)
+			DataSetStorage = storage
+		})
+
+		AfterEach(func() {
+			defer testServer.Close()
+		})
+
+		It("Should append a row for each record", func() {
+			response := post("animal,count\nparrot,1\nparakeet,2\n")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status: "ok",
+				Meta:   &ResponseMeta{Inserted: 2}}))
+			Expect(storage.saved).Should(Equal(2))
+		})
+
+		It("Should store the booleans it infers", func() {
+			Expect(post("animal,pining\nparrot,true\n").StatusCode).Should(Equal(http.StatusOK))
+		})
+
+		It("Should accept CSV when the upload format is csv", func() {
+			withUploadFormat("csv")
+
+			Expect(post("animal\nparrot\n").StatusCode).Should(Equal(http.StatusOK))
+		})
+
+		It("Should not accept CSV when the upload format is something else", func() {
+			withUploadFormat("excel")
+
+			response := post("animal\nparrot\n")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusUnsupportedMediaType))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("the-dataset does not accept text/csv uploads")))
+			Expect(storage.saved).Should(Equal(0))
+		})
+
+		It("Should reshape the records with the upload filters, skipping unknown ones", func() {
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset",
+						UploadFilters: []string{
+							"backdrop.contrib.evl_upload_filters.channel_volumetrics",
+							"drop_rows:1",
+							"rename_column:Bird:animal"}}))
+
+			response := post("Bird\nheading\nparrot\n")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.saved).Should(Equal(1))
+			Expect(storage.records[0]["animal"]).Should(Equal("parrot"))
+		})
+
+		It("Should report records which the upload filters can't reshape", func() {
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken:   "the-bearer-token",
+						Name:          "the-dataset",
+						UploadFilters: []string{"rename_column:Bird:animal"}}))
+
+			response := post("Bird,animal\nparrot,parakeet\n")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "there is already a animal column, so Bird can't be renamed",
+				Errors: []ErrorInfo{
+					ErrorInfo{
+						Status: "400",
+						Code:   "upload_filter_failed",
+						Detail: "there is already a animal column, so Bird can't be renamed",
+						Path:   "/0"}}}))
+			Expect(storage.saved).Should(Equal(0))
+		})
+
+		It("Should not run the upload filters on JSON", func() {
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken:   "the-bearer-token",
+						Name:          "the-dataset",
+						UploadFilters: []string{"drop_rows:1"}}))
+
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(`[{"animal": "parrot"}]`))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(storage.saved).Should(Equal(1))
+		})
+
+		It("Should report the row and column of parse errors", func() {
+			response := post("animal,\nparrot,1\n")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Error parsing CSV: row 1, column 2: header is empty")))
+			Expect(storage.saved).Should(Equal(0))
+		})
+	})
+
+	Describe("Uploading spreadsheets", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		post := func(query string, body string) *http.Response {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type"+query, strings.NewReader(body))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			return response
+		}
+
+		withUploadFormat := func(format string) {
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken:  "the-bearer-token",
+						Name:         "the-dataset",
+						UploadFormat: format}))
+		}
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			withUploadFormat("excel")
+			storage = newTestDataSetStorage(Alive(true), Exists(true)).(*TestDataSetStorage)
+			DataSetStorage = storage
+		})
+
+		AfterEach(func() {
+			defer testServer.Close()
+		})
+
+		It("Should not accept spreadsheets when the upload format isn't excel", func() {
+			withUploadFormat("")
+
+			response := post("", "not a spreadsheet")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusUnsupportedMediaType))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse(
+				"the-dataset does not accept application/vnd.openxmlformats-officedocument.spreadsheetml.sheet uploads")))
+		})
+
+		It("Should need a positive header_row", func() {
+			response := post("?header_row=0", "not a spreadsheet")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("header_row must be a positive integer")))
+		})
+
+		It("Should fail when the body isn't a spreadsheet", func() {
+			response := post("?sheet=Sheet1", "not a spreadsheet")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Error parsing spreadsheet: not an xlsx file: zip: not a valid zip file")))
+			Expect(storage.saved).Should(Equal(0))
+		})
+	})
+
+	Describe("Streaming data", func() {
+		var testServer *httptest.Server
+		var client *http.Client
+		var storage *TestDataSetStorage
+
+		post := func(body string, headers ...string) *http.Response {
+			req, err := http.NewRequest("POST", testServer.URL+"/data/a-data-group/a-data-type", strings.NewReader(body))
+			Expect(err).Should(BeNil())
+			req.Header.Add("Authorization", "Bearer the-bearer-token")
+			req.Header.Add("Content-Type", "application/x-ndjson; charset=utf-8")
+			for i := 0; i < len(headers); i += 2 {
+				req.Header.Add(headers[i], headers[i+1])
+			}
+
+			response, err := client.Do(req)
+			Expect(err).Should(BeNil())
+			return response
+		}
+
+		BeforeEach(func() {
+			handler := newHandler(10000000)
+			testServer = testHandlerServer(handler)
+			client = &http.Client{}
+			ConfigAPIClient = newTestConfigAPIClient(
+				MetaData(
+					&config.DataSetMetaData{
+						BearerToken: "the-bearer-token",
+						Name:        "the-dataset"}))
+			storage = newTestDataSetStorage(Alive(true), Exists(true)).(*TestDataSetStorage)
+			DataSetStorage = storage
+			NDJSONBatchSize = 2
+		})
+
+		AfterEach(func() {
+			NDJSONBatchSize = 1000
+			defer testServer.Close()
+		})
+
+		It("Should write every line in batches", func() {
+			response := post("{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n\n{\"_id\": \"c\"}\n{\"_id\": \"a\"}\n{\"_id\": \"d\"}")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "ok",
+				Message: "Processed 5 records for the-dataset",
+				Meta:    &ResponseMeta{Inserted: 4, Updated: 1, Processed: 5}}))
+			Expect(storage.saved).Should(Equal(5))
+		})
+
+		It("Should need at least one record", func() {
+			response := post("\n\n")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Expected NDJSON request body but received no records")))
+		})
+
+		It("Should keep the records before a line which isn't JSON", func() {
+			response := post("{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n{\"_id\": \"c\"}\nnot JSON\n{\"_id\": \"d\"}")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "Error parsing JSON on line 4: invalid character 'o' in literal null (expecting 'u')",
+				Errors: []ErrorInfo{{
+					Detail: "Error parsing JSON on line 4: invalid character 'o' in literal null (expecting 'u')"}},
+				Meta: &ResponseMeta{Inserted: 3, Processed: 3}}))
+			Expect(storage.saved).Should(Equal(3))
+		})
+
+		It("Should report validation errors against the position in the whole upload", func() {
+			response := post("{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n{\"_id\": \"c\"}\n{\"a/b\": \"d\"}")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "a/b is not a valid key",
+				Errors: []ErrorInfo{{
+					Status: "400",
+					Code:   dataset.InvalidKeyCode,
+					Detail: "a/b is not a valid key",
+					Path:   "/3/a~1b"}},
+				Meta: &ResponseMeta{Inserted: 2, Processed: 2}}))
+			Expect(storage.saved).Should(Equal(2))
+		})
+
+		It("Should keep the records before a line which is too long", func() {
+			NDJSONMaxLineSize = 32
+			defer func() { NDJSONMaxLineSize = 1 << 20 }()
+
+			response := post("{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n{\"_id\": \"c\"}\n{\"_id\": \"d\", \"animal\": \"a very long parrot\"}\n{\"_id\": \"e\"}")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "Line 4 is longer than the limit of 32 bytes",
+				Errors: []ErrorInfo{{
+					Status: "400",
+					Code:   dataset.RecordTooLargeCode,
+					Detail: "Line 4 is longer than the limit of 32 bytes",
+					Path:   "/3"}},
+				Meta: &ResponseMeta{Inserted: 3, Processed: 3}}))
+			Expect(storage.saved).Should(Equal(3))
+		})
+
+		It("Should keep the records before a line which isn't an object", func() {
+			response := post("{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n1\n{\"_id\": \"c\"}")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(APIResponse{
+				Status:  "error",
+				Message: "Line 3 is not a JSON object",
+				Errors: []ErrorInfo{{
+					Status: "400",
+					Code:   dataset.NotAnObjectCode,
+					Detail: "Line 3 is not a JSON object",
+					Path:   "/2"}},
+				Meta: &ResponseMeta{Inserted: 2, Processed: 2}}))
+			Expect(storage.saved).Should(Equal(2))
+		})
+
+		It("Should not support Idempotency-Keys", func() {
+			response := post("{\"_id\": \"a\"}", "Idempotency-Key", "a-key")
+
+			Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(response).Should(EqualAPIResponse(newErrorAPIResponse("Idempotency-Key is not supported for application/x-ndjson uploads")))
+			Expect(storage.saved).Should(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("MemoryIdempotencyStore", func() {
+	It("Should report keys which are still being processed", func() {
+		store := NewMemoryIdempotencyStore(time.Hour)
+
+		_, ok := store.Start("a-key", "a-hash")
+		Expect(ok).Should(BeTrue())
+
+		previous, ok := store.Start("a-key", "a-hash")
+		Expect(ok).Should(BeFalse())
+		Expect(previous.Complete).Should(BeFalse())
+	})
+
+	It("Should forget keys once they have expired", func() {
+		store := NewMemoryIdempotencyStore(time.Nanosecond)
+
+		store.Start("a-key", "a-hash")
+		store.Finish("a-key", IdempotentResponse{BodyHash: "a-hash", Status: http.StatusOK})
+		time.Sleep(time.Millisecond)
+
+		_, ok := store.Start("a-key", "another-hash")
+		Expect(ok).Should(BeTrue())
+	})
+})
+
+var _ = Describe("JobQueue", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "jobs")
+		Expect(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Should queue jobs again after a restart", func() {
+		queue, err := NewJobQueue(dir, time.Hour)
+		Expect(err).Should(BeNil())
+		first, err := queue.Enqueue("a-data-group", "a-data-type", []interface{}{map[string]interface{}{"count": int64(1)}})
+		Expect(err).Should(BeNil())
+		second, err := queue.Enqueue("a-data-group", "a-data-type", []interface{}{map[string]interface{}{"count": 2.0}})
+		Expect(err).Should(BeNil())
+
+		restarted, err := NewJobQueue(dir, time.Hour)
+		Expect(err).Should(BeNil())
+
+		job, ok := restarted.Get(first.ID)
+		Expect(ok).Should(BeTrue())
+		Expect(job.Status).Should(Equal(JobQueued))
+		Expect(restarted.pending).Should(Equal([]string{first.ID, second.ID}))
+	})
+
+	It("Should keep the types of values in records", func() {
+		queue, err := NewJobQueue(dir, time.Hour)
+		Expect(err).Should(BeNil())
+		records := []interface{}{map[string]interface{}{
+			"count":  int64(9007199254740993),
+			"rate":   2.0,
+			"pining": true,
+			"none":   nil,
+			"device": map[string]interface{}{"versions": []interface{}{"4.4", int64(5)}}}}
+
+		job, err := queue.Enqueue("a-data-group", "a-data-type", records)
+		Expect(err).Should(BeNil())
+
+		Expect(queue.readRecords(job.ID)).Should(Equal(records))
+	})
+})
+
+// blockingStorage holds up saving records until release is closed.
+type blockingStorage struct {
+	*TestDataSetStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStorage) SaveRecords(name string, records []map[string]interface{}) (dataset.WriteResult, error) {
+	close(b.started)
+	<-b.release
+	return b.TestDataSetStorage.SaveRecords(name, records)
+}
+
+func newJournalLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+var _ = Describe("JournaledStorage", func() {
+	var dir string
+	var storage *TestDataSetStorage
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "journal")
+		Expect(err).Should(BeNil())
+		storage = newTestDataSetStorage(Alive(true), Unreachable(true)).(*TestDataSetStorage)
+		StatsdClient = newTestStatsdClient()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Should apply writes straight away when storage is reachable", func() {
+		storage.unreachable = false
+		journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+
+		result, err := journal.SaveRecords("a-dataset", []map[string]interface{}{{"_id": "one"}})
+		Expect(err).Should(BeNil())
+		Expect(result).Should(Equal(dataset.WriteResult{Inserted: 1}))
+		Expect(journal.Depth()).Should(Equal(0))
+
+		files, _ := ioutil.ReadDir(dir)
+		Expect(files).Should(BeEmpty())
+	})
+
+	It("Should replay the journal after a restart", func() {
+		journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+		records := []map[string]interface{}{{
+			"count":      int64(9007199254740993),
+			"_timestamp": time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC),
+			"device":     map[string]interface{}{"versions": []interface{}{"4.4", int64(5)}}}}
+
+		result, err := journal.SaveRecords("a-dataset", records)
+		Expect(err).Should(BeNil())
+		Expect(result).Should(Equal(dataset.WriteResult{Journaled: 1}))
+
+		storage.unreachable = false
+		restarted, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+		Expect(restarted.Depth()).Should(Equal(1))
+
+		Expect(restarted.Replay()).Should(Equal(0))
+		Expect(storage.records).Should(Equal(records))
+	})
+
+	It("Should replay versioned writes as versioned writes", func() {
+		journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+
+		result, err := journal.SaveVersions("a-dataset", []map[string]interface{}{{"_id": "one"}}, time.Now())
+		Expect(err).Should(BeNil())
+		Expect(result).Should(Equal(dataset.WriteResult{Journaled: 1}))
+
+		storage.unreachable = false
+		Expect(journal.Replay()).Should(Equal(0))
+		Expect(storage.versioned).Should(BeTrue())
+		Expect(storage.saved).Should(Equal(1))
+	})
+
+	It("Should report that a DataSet exists while its creation is journaled", func() {
+		journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+
+		Expect(journal.Exists("a-dataset")).Should(BeFalse())
+		Expect(journal.Create("a-dataset", 0)).Should(BeNil())
+		Expect(journal.Exists("a-dataset")).Should(BeTrue())
+		Expect(journal.Alive()).Should(BeFalse())
+	})
+
+	It("Should drop writes which storage rejects and carry on", func() {
+		journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+		journal.Empty("a-dataset")
+		journal.SaveRecords("a-dataset", []map[string]interface{}{{"_id": "one"}})
+
+		storage.unreachable = false
+		storage.error = fmt.Errorf("Not allowed")
+		Expect(journal.Replay()).Should(Equal(0))
+
+		testStatsd := StatsdClient.(*testStatsdClient)
+		Expect(testStatsd.incOps).Should(HaveLen(2))
+		Expect(testStatsd.incOps[0].stat).Should(Equal("journal.error.a-dataset"))
+	})
+
+	It("Should fail writes which make storage panic rather than keeping them", func() {
+		storage.unreachable = false
+		journal, err := NewJournaledStorage(dir, panickingStorage{storage}, newJournalLogger())
+		Expect(err).Should(BeNil())
+
+		_, err = journal.SaveRecords("a-dataset", []map[string]interface{}{{"_id": "one"}})
+		Expect(err).Should(MatchError("storage panicked: the storage failed"))
+		Expect(journal.Depth()).Should(Equal(0))
+
+		_, err = journal.SaveRecords("a-dataset", []map[string]interface{}{{"_id": "two"}})
+		Expect(err).Should(MatchError("storage panicked: the storage failed"))
+	})
+
+	It("Should not hold the lock while a write is in flight", func() {
+		storage.unreachable = false
+		blocking := &blockingStorage{storage, make(chan struct{}), make(chan struct{})}
+		journal, err := NewJournaledStorage(dir, blocking, newJournalLogger())
+		Expect(err).Should(BeNil())
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			journal.SaveRecords("a-dataset", []map[string]interface{}{{"_id": "one"}})
+		}()
+		<-blocking.started
+
+		Expect(journal.Depth()).Should(Equal(1))
+		Expect(journal.Replay()).Should(Equal(1))
+		Expect(journal.Exists("a-dataset")).Should(BeFalse())
+
+		close(blocking.release)
+		Eventually(done).Should(BeClosed())
+		Expect(journal.Depth()).Should(Equal(0))
+		Expect(storage.saved).Should(Equal(1))
+	})
+
+	It("Should not delete records while there are writes in the journal", func() {
+		journal, err := NewJournaledStorage(dir, storage, newJournalLogger())
+		Expect(err).Should(BeNil())
+		journal.Empty("a-dataset")
+
+		_, err = journal.DeleteRecords("a-dataset", dataset.RecordFilter{ID: "one"})
+		Expect(err).Should(MatchError("Unable to delete records from a-dataset while 1 writes are waiting to be applied"))
+		Expect(storage.deleted).Should(BeFalse())
+	})
+})
+
+var _ = Describe("RateLimiter", func() {
+	var limiter *RateLimiter
+	var now time.Time
+	rate := config.RateLimit{PerSecond: 2, Burst: 4}
+	tokens := func(n int) map[string]Tokens {
+		return map[string]Tokens{"a-key": {n, rate}}
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC)
+		limiter = NewRateLimiter()
+		limiter.now = func() time.Time { return now }
+	})
+
+	It("Should allow a burst and then refill at the rate", func() {
+		_, _, ok := limiter.Take(tokens(4))
+		Expect(ok).Should(BeTrue())
+
+		retryAfter, limitedBy, ok := limiter.Take(tokens(1))
+		Expect(ok).Should(BeFalse())
+		Expect(retryAfter).Should(Equal(500 * time.Millisecond))
+		Expect(limitedBy).Should(Equal("a-key"))
+
+		now = now.Add(500 * time.Millisecond)
+		_, _, ok = limiter.Take(tokens(1))
+		Expect(ok).Should(BeTrue())
+	})
+
+	It("Should allow a take larger than the burst when the bucket is full", func() {
+		_, _, ok := limiter.Take(tokens(10))
+		Expect(ok).Should(BeTrue())
+
+		retryAfter, _, ok := limiter.Take(tokens(1))
+		Expect(ok).Should(BeFalse())
+		Expect(retryAfter).Should(Equal(3500 * time.Millisecond))
+	})
+
+	It("Should take nothing unless every bucket has enough", func() {
+		slow := config.RateLimit{PerSecond: 1, Burst: 1}
+
+		_, _, ok := limiter.Take(map[string]Tokens{"another-key": {1, slow}})
+		Expect(ok).Should(BeTrue())
+		_, limitedBy, ok := limiter.Take(map[string]Tokens{"a-key": {2, rate}, "another-key": {1, slow}})
+		Expect(ok).Should(BeFalse())
+		Expect(limitedBy).Should(Equal("another-key"))
+
+		_, _, ok = limiter.Take(tokens(4))
+		Expect(ok).Should(BeTrue())
+	})
+
+	It("Should take different numbers of tokens from each bucket", func() {
+		_, _, ok := limiter.Take(map[string]Tokens{"a-key": {1, rate}, "another-key": {3, rate}})
+		Expect(ok).Should(BeTrue())
+
+		_, _, ok = limiter.Take(map[string]Tokens{"a-key": {3, rate}, "another-key": {1, rate}})
+		Expect(ok).Should(BeTrue())
+		_, limitedBy, ok := limiter.Take(map[string]Tokens{"a-key": {0, rate}, "another-key": {1, rate}})
+		Expect(ok).Should(BeFalse())
+		Expect(limitedBy).Should(Equal("another-key"))
+	})
+
+	It("Should check without taking anything", func() {
+		_, _, ok := limiter.Check(tokens(4))
+		Expect(ok).Should(BeTrue())
+		_, _, ok = limiter.Take(tokens(4))
+		Expect(ok).Should(BeTrue())
+
+		retryAfter, _, ok := limiter.Check(tokens(1))
+		Expect(ok).Should(BeFalse())
+		Expect(retryAfter).Should(Equal(500 * time.Millisecond))
+	})
+
+	It("Should forget buckets once they have refilled", func() {
+		limiter.Take(tokens(4))
+		limiter.Take(map[string]Tokens{"slow-key": {1, config.RateLimit{PerSecond: 0.001, Burst: 1}}})
+
+		now = now.Add(rateLimiterSweepInterval)
+		limiter.Take(map[string]Tokens{"another-key": {1, config.RateLimit{PerSecond: 1, Burst: 1}}})
+
+		Expect(limiter.buckets).ShouldNot(HaveKey("a-key"))
+		Expect(limiter.buckets).Should(HaveKey("slow-key"))
+		Expect(limiter.buckets).Should(HaveKey("another-key"))
+	})
+
+	It("Should not limit without a rate", func() {
+		_, _, ok := limiter.Take(map[string]Tokens{"a-key": {1000000, config.RateLimit{}}})
+		Expect(ok).Should(BeTrue())
+	})
+
+	It("Should parse rate limits", func() {
+		Expect(ParseRateLimit("")).Should(Equal(config.RateLimit{}))
+		Expect(ParseRateLimit("2.5")).Should(Equal(config.RateLimit{PerSecond: 2.5, Burst: 3}))
+		Expect(ParseRateLimit("10:100")).Should(Equal(config.RateLimit{PerSecond: 10, Burst: 100}))
+
+		_, err := ParseRateLimit("fast")
+		Expect(err).Should(MatchError(`invalid rate limit "fast"`))
+		_, err = ParseRateLimit("10:0")
+		Expect(err).Should(MatchError(`invalid rate limit "10:0"`))
+	})
 })
 
 // APIResponseMatcher implements gomega.types.GomegaMatcher
@@ -10,20 +10,34 @@ import (
 	"github.com/alphagov/performance-datastore/pkg/dataset"
 )
 
-// StatusHandler is the basic healthcheck for the application
+// StatusHandler is the basic healthcheck for the application.
+// If writes are journaled, the number waiting to be applied is reported as
+// the journal-depth.
 //
 // GET /_status
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	setStatusHeaders(w)
 
+	status := http.StatusOK
+	response := map[string]interface{}{
+		"status":  "ok",
+		"message": "database seems fine",
+	}
+
 	if !DataSetStorage.Alive() {
-		renderError(w, http.StatusInternalServerError, "cannot connect to database")
-	} else {
-		renderer.JSON(w, http.StatusOK, map[string]string{
-			"status":  "ok",
-			"message": "database seems fine",
-		})
+		status = http.StatusInternalServerError
+		response = map[string]interface{}{
+			"status":  "error",
+			"message": "cannot connect to database",
+			"errors":  newErrorInfos("cannot connect to database"),
+		}
+	}
+
+	if journal, ok := DataSetStorage.(*JournaledStorage); ok {
+		response["journal-depth"] = journal.Depth()
 	}
+
+	renderer.JSON(w, status, response)
 }
 
 // DataSetStatus is a representation of health for a DataSet.
@@ -49,7 +63,13 @@ func DataSetStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	failing := collectStaleness(datasets)
+	failing, err := collectStaleness(datasets)
+
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	status := summariseStaleness(failing)
 
 	setStatusHeaders(w)
@@ -60,31 +80,42 @@ func DataSetStatusHandler(w http.ResponseWriter, r *http.Request) {
 func checkFreshness(
 	dataSet dataset.DataSet,
 	failing chan DataSetStatus,
+	errs chan error,
 	wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	if staleness := dataSet.IsStale(); staleness.IsStale() && dataSet.IsPublished() {
+	staleness, err := dataSet.IsStale()
+	if err != nil {
+		errs <- err
+		return
+	}
+
+	if staleness.IsStale() && dataSet.IsPublished() {
 		failing <- DataSetStatus{dataSet.Name(), staleness.SecondsOutOfDate, *staleness.LastUpdated, *staleness.MaxExpectedAge}
 	}
 }
 
-func collectStaleness(datasets []config.DataSetMetaData) (failing chan DataSetStatus) {
+// collectStaleness checks every DataSet at once, returning the stale ones, or
+// the first error if the freshness of any of them couldn't be checked.
+func collectStaleness(datasets []config.DataSetMetaData) (failing chan DataSetStatus, err error) {
 	failing = make(chan DataSetStatus, len(datasets))
 
 	if len(datasets) == 0 {
 		return
 	}
 
+	errs := make(chan error, len(datasets))
 	wg := &sync.WaitGroup{}
 	wg.Add(len(datasets))
 
 	for _, metaData := range datasets {
-		go checkFreshness(dataset.DataSet{DataSetStorage, metaData}, failing, wg)
+		go checkFreshness(dataset.DataSet{DataSetStorage, metaData}, failing, errs, wg)
 	}
 
 	wg.Wait()
+	close(errs)
 
-	return
+	return failing, <-errs
 }
 
 func setStatusHeaders(w http.ResponseWriter) {
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotentResponse is what we remember about a write request made with an
+// Idempotency-Key header, so that retries of it can be answered without
+// writing the data again.
+type IdempotentResponse struct {
+	BodyHash string
+	Complete bool
+	Status   int
+	Header   http.Header
+	Body     []byte
+}
+
+// IdempotencyStore defines the behaviour we need to remember responses to write requests.
+type IdempotencyStore interface {
+	// Start records that a request for key is being processed. If key has
+	// already been seen, the earlier response is returned and ok is false.
+	Start(key string, bodyHash string) (previous *IdempotentResponse, ok bool)
+	// Finish stores the response to a request which was started.
+	Finish(key string, response IdempotentResponse)
+	// Forget removes a key, so that the request can be tried again.
+	Forget(key string)
+}
+
+type memoryIdempotencyStore struct {
+	sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	response IdempotentResponse
+	expires  time.Time
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore which keeps responses in memory for ttl.
+func NewMemoryIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &memoryIdempotencyStore{
+		ttl:       ttl,
+		responses: make(map[string]*idempotencyEntry),
+	}
+}
+
+func (s *memoryIdempotencyStore) Start(key string, bodyHash string) (*IdempotentResponse, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	if entry, ok := s.responses[key]; ok && now.Before(entry.expires) {
+		previous := entry.response
+		return &previous, false
+	}
+
+	s.responses[key] = &idempotencyEntry{
+		response: IdempotentResponse{BodyHash: bodyHash},
+		expires:  now.Add(s.ttl),
+	}
+	return nil, true
+}
+
+func (s *memoryIdempotencyStore) Finish(key string, response IdempotentResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	response.Complete = true
+	s.responses[key] = &idempotencyEntry{response, time.Now().Add(s.ttl)}
+}
+
+func (s *memoryIdempotencyStore) Forget(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.responses, key)
+}
+
+// sweep drops expired responses, at most once a minute so that busy servers
+// don't spend their time walking the map.
+func (s *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, entry := range s.responses {
+		if !now.Before(entry.expires) {
+			delete(s.responses, key)
+		}
+	}
+}
+
+// recordingResponseWriter keeps a copy of everything written to the delegate
+// http.ResponseWriter so that the response can be replayed.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingResponseWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// withIdempotencyKey calls handle unless the request has an Idempotency-Key
+// header which has already been used for dataSetName and the request's path,
+// in which case the original response is replayed. Using a key again with a
+// different request body is a conflict. Responses to requests which failed
+// because of a server error, or a panic, aren't kept, so that they can be
+// retried.
+func withIdempotencyKey(w http.ResponseWriter, r *http.Request, dataSetName string, body []byte, handle func(w http.ResponseWriter)) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || IdempotencyKeys == nil {
+		handle(w)
+		return
+	}
+
+	storeKey := dataSetName + "\n" + r.URL.Path + "\n" + key
+	bodyHash := hashRequest(r.Method, r.URL.Path, body)
+
+	previous, ok := IdempotencyKeys.Start(storeKey, bodyHash)
+	if !ok {
+		switch {
+		case previous.BodyHash != bodyHash:
+			renderError(w, http.StatusConflict, "Idempotency-Key '"+key+"' has already been used for a different request")
+		case !previous.Complete:
+			renderError(w, http.StatusConflict, "A request with Idempotency-Key '"+key+"' is still being processed")
+		default:
+			replayResponse(w, previous)
+		}
+		return
+	}
+
+	finished := false
+	defer func() {
+		if !finished {
+			IdempotencyKeys.Forget(storeKey)
+		}
+	}()
+
+	recorder := &recordingResponseWriter{ResponseWriter: w}
+	handle(recorder)
+
+	// requests which failed or were rate limited didn't change anything, so
+	// can be tried again with the same key
+	if recorder.status >= http.StatusInternalServerError || recorder.status == http.StatusTooManyRequests {
+		return
+	}
+
+	IdempotencyKeys.Finish(storeKey, IdempotentResponse{
+		BodyHash: bodyHash,
+		Status:   recorder.status,
+		Header:   cloneHeader(w.Header()),
+		Body:     recorder.body.Bytes()})
+	finished = true
+}
+
+func replayResponse(w http.ResponseWriter, response *IdempotentResponse) {
+	for k, v := range response.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.Status)
+	w.Write(response.Body)
+}
+
+func hashRequest(method string, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + "\n" + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for k, v := range header {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/gorilla/mux"
+)
+
+// The states of a Job.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is a write request which is processed in the background.
+type Job struct {
+	ID        string      `json:"id"`
+	DataGroup string      `json:"data_group"`
+	DataType  string      `json:"data_type"`
+	Status    string      `json:"status"`
+	Total     int         `json:"total"`
+	Processed int         `json:"processed"`
+	Inserted  int         `json:"inserted"`
+	Updated   int         `json:"updated"`
+	Journaled int         `json:"journaled,omitempty"`
+	Errors    []ErrorInfo `json:"errors,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+func (j Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// JobQueue keeps the jobs for asynchronous writes in a directory, so that
+// queued jobs survive a restart, and runs them one at a time. Finished jobs
+// are kept for ttl so that clients can find out how they went.
+type JobQueue struct {
+	sync.Mutex
+	dir       string
+	ttl       time.Duration
+	jobs      map[string]*Job
+	pending   []string
+	wake      chan struct{}
+	lastSweep time.Time
+}
+
+// NewJobQueue returns a JobQueue which keeps its jobs in dir, creating it if
+// necessary. Jobs which were queued or running when the queue was last used
+// are queued again.
+func NewJobQueue(dir string, ttl time.Duration) (*JobQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &JobQueue{
+		dir:  dir,
+		ttl:  ttl,
+		jobs: make(map[string]*Job),
+		wake: make(chan struct{}, 1),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var queued []*Job
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var job Job
+		if err := json.Unmarshal(body, &job); err != nil {
+			return nil, fmt.Errorf("Unable to read the job in %s: %v", file, err)
+		}
+		q.jobs[job.ID] = &job
+
+		if !job.finished() {
+			queued = append(queued, &job)
+		}
+	}
+
+	// jobs which were interrupted start again from the beginning of the batch
+	// they were writing, in the order they were queued
+	sort.Sort(byCreation(queued))
+	for _, job := range queued {
+		job.Status = JobQueued
+		q.pending = append(q.pending, job.ID)
+	}
+	if len(q.pending) > 0 {
+		q.wake <- struct{}{}
+	}
+
+	return q, nil
+}
+
+// byCreation sorts jobs into the order they were queued.
+type byCreation []*Job
+
+func (j byCreation) Len() int           { return len(j) }
+func (j byCreation) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
+func (j byCreation) Less(a, b int) bool { return j[a].CreatedAt.Before(j[b].CreatedAt) }
+
+// Enqueue stores the records for a DataSet and queues a job to write them.
+func (q *JobQueue) Enqueue(dataGroup string, dataType string, records []interface{}) (Job, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:        id,
+		DataGroup: dataGroup,
+		DataType:  dataType,
+		Status:    JobQueued,
+		Total:     len(records),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := q.writeRecords(id, records); err != nil {
+		return Job{}, err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.sweep(now)
+
+	if err := q.save(job); err != nil {
+		os.Remove(q.recordsPath(id))
+		return Job{}, err
+	}
+
+	q.jobs[id] = job
+	q.pending = append(q.pending, id)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return *job, nil
+}
+
+// Get returns the job with id.
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Run processes queued jobs until stop is closed.
+func (q *JobQueue) Run(logger *logrus.Logger, stop <-chan struct{}) {
+	for {
+		for {
+			id, ok := q.next()
+			if !ok {
+				break
+			}
+			q.process(id, logger)
+		}
+
+		select {
+		case <-q.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (q *JobQueue) next() (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.pending) == 0 {
+		return "", false
+	}
+
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id, true
+}
+
+// process writes the records of a job. Like JSON uploads, and unlike NDJSON
+// uploads, jobs are all-or-nothing: every record is validated before any are
+// written, and they are saved together so that a failure keeps none of them.
+// A job which panics fails, rather than stopping the queue.
+func (q *JobQueue) process(id string, logger *logrus.Logger) {
+	job, _ := q.Get(id)
+	job.Status = JobRunning
+	q.update(job, logger)
+
+	finish := func(err error) {
+		job.Status = JobSucceeded
+		if err != nil {
+			job.Status = JobFailed
+			if errors, ok := err.(dataset.ValidationErrors); ok {
+				job.Errors = newValidationErrorInfos(errors)
+			} else {
+				job.Errors = newErrorInfos(err.Error())
+				logger.WithField("job", job.ID).Errorf("Unable to write records: %v", err)
+			}
+		}
+		q.update(job, logger)
+		os.Remove(q.recordsPath(job.ID))
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			logger.WithField("job", job.ID).Errorf("PANIC: %s\n%s", err, stack(3))
+			finish(fmt.Errorf("%v", err))
+		}
+	}()
+
+	records, err := q.readRecords(job.ID)
+	if err != nil {
+		finish(fmt.Errorf("Unable to read the records for job %s: %v", job.ID, err))
+		return
+	}
+
+	metaData, err := fetchDataMetaData(job.DataGroup, job.DataType)
+	if err != nil {
+		finish(err)
+		return
+	}
+	dataSet := dataset.DataSet{DataSetStorage, *metaData}
+
+	result, err := dataSet.Append(records)
+	if err != nil {
+		if _, ok := err.(dataset.ValidationErrors); !ok {
+			StatsdClient.Incr("write.error."+dataSet.Name(), 1)
+		}
+		finish(err)
+		return
+	}
+
+	job.Processed = len(records)
+	job.Inserted = result.Inserted
+	job.Updated = result.Updated
+	job.Journaled = result.Journaled
+	finish(nil)
+}
+
+func (q *JobQueue) update(job Job, logger *logrus.Logger) {
+	job.UpdatedAt = time.Now()
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.jobs[job.ID] = &job
+	if err := q.save(&job); err != nil {
+		logger.WithField("job", job.ID).Errorf("Unable to save job: %v", err)
+	}
+}
+
+// sweep removes finished jobs once they are older than the queue's ttl, at
+// most once a minute.
+func (q *JobQueue) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < time.Minute {
+		return
+	}
+	q.lastSweep = now
+
+	for id, job := range q.jobs {
+		if job.finished() && now.Sub(job.UpdatedAt) > q.ttl {
+			delete(q.jobs, id)
+			os.Remove(q.jobPath(id))
+		}
+	}
+}
+
+func (q *JobQueue) jobPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *JobQueue) recordsPath(id string) string {
+	return filepath.Join(q.dir, id+".records")
+}
+
+// save writes a job to a temporary file and renames it into place, so that a
+// crash can't leave a job half written.
+func (q *JobQueue) save(job *Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	temp := q.jobPath(job.ID) + ".tmp"
+	if err := ioutil.WriteFile(temp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, q.jobPath(job.ID))
+}
+
+// writeRecords stores records with gob rather than JSON, so that the types of
+// their values, like int64 and float64, survive.
+func (q *JobQueue) writeRecords(id string, records []interface{}) error {
+	f, err := os.OpenFile(q.recordsPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(f).Encode(records); err != nil {
+		f.Close()
+		os.Remove(q.recordsPath(id))
+		return err
+	}
+	return f.Close()
+}
+
+func (q *JobQueue) readRecords(id string) (records []interface{}, err error) {
+	f, err := os.Open(q.recordsPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&records)
+	return
+}
+
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// prefersAsync reports whether the request has a Prefer: respond-async header.
+func prefersAsync(r *http.Request) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			token := strings.TrimSpace(strings.SplitN(preference, ";", 2)[0])
+			if strings.EqualFold(token, "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enqueueWrite queues the records to be appended to dataSet in the background,
+// and responds with a link to the job.
+func enqueueWrite(w http.ResponseWriter, r *http.Request, jsonArray []interface{}, dataSet dataset.DataSet) {
+	for i, record := range jsonArray {
+		if _, ok := record.(map[string]interface{}); !ok {
+			renderError(w, http.StatusBadRequest, fmt.Sprintf("Expected record %d to be a JSON object", i))
+			return
+		}
+	}
+
+	params := mux.Vars(r)
+	job, err := Jobs.Enqueue(params["data_group"], params["data_type"], jsonArray)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to queue the records for %s: %v", dataSet.Name(), err))
+		return
+	}
+
+	location := "/_jobs/" + job.ID
+	w.Header().Set("Location", location)
+	w.Header().Set("Preference-Applied", "respond-async")
+	renderer.JSON(w, http.StatusAccepted, APIResponse{
+		Status:  "accepted",
+		Message: fmt.Sprintf("Queued %d records for %s", job.Total, dataSet.Name()),
+		Links:   map[string]string{"job": location}})
+}
+
+// JobHandler reports the progress of an asynchronous write.
+//
+// GET /_jobs/:id
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var job Job
+	ok := false
+	if Jobs != nil {
+		job, ok = Jobs.Get(id)
+	}
+
+	if !ok {
+		renderError(w, http.StatusNotFound, fmt.Sprintf("No job with id '%s'", id))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	renderer.JSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,558 @@
+package handlers
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+)
+
+// The writes which a JournaledStorage journals.
+const (
+	journalCreate          = "create"
+	journalSave            = "save"
+	journalReplace         = "replace"
+	journalEmpty           = "empty"
+	journalVersion         = "save-versions"
+	journalReplaceVersions = "replace-versions"
+)
+
+// journalEntry is a write to a DataSet, kept in the journal until it has been
+// applied to storage.
+type journalEntry struct {
+	Seq        uint64
+	Op         string
+	Name       string
+	CappedSize int64
+	Records    []map[string]interface{}
+	Time       time.Time
+}
+
+// journalOutcome is the result of applying a journaled write, kept for the
+// request which is waiting for it.
+type journalOutcome struct {
+	result dataset.WriteResult
+	err    error
+}
+
+// removing is the in-flight marker while records are being removed, which
+// isn't a journaled write.
+const removing = ^uint64(0)
+
+// unavailableError is a failure to reach storage, as opposed to storage
+// rejecting a write.
+type unavailableError struct {
+	cause interface{}
+}
+
+func (e unavailableError) Error() string {
+	return fmt.Sprintf("storage is unavailable: %v", e.cause)
+}
+
+// JournaledStorage is a DataSetStorage which appends every write to a journal
+// on disk before applying it to the storage it wraps. If that storage can't be
+// reached the write stays in the journal, and is applied along with any others
+// by Replay once it can be, so writes aren't lost while the database is down.
+//
+// Writes are applied in the order they were journaled, one at a time, by
+// whichever request or Replay finds nothing in flight. Storage is called
+// without holding the lock, so requests aren't held up behind a slow write
+// any longer than they have to be. A write which was being applied when the
+// process stopped is applied again, so records without an _id may be written
+// twice.
+type JournaledStorage struct {
+	// depth is read without the lock, so is first to keep it 64 bit aligned
+	depth int64
+	sync.Mutex
+	storage     dataset.DataSetStorage
+	dir         string
+	logger      *logrus.Logger
+	next        uint64
+	pending     []uint64
+	inFlight    uint64
+	changed     *sync.Cond
+	waiting     map[uint64]bool
+	outcomes    map[uint64]journalOutcome
+	creating    map[string]bool
+	unavailable bool
+}
+
+// NewJournaledStorage returns a JournaledStorage which journals the writes to
+// storage in dir, creating it if necessary. Writes which were still in the
+// journal when it was last used are applied by the next Replay.
+func NewJournaledStorage(dir string, storage dataset.DataSetStorage, logger *logrus.Logger) (*JournaledStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	j := &JournaledStorage{
+		storage:  storage,
+		dir:      dir,
+		logger:   logger,
+		next:     1,
+		waiting:  make(map[uint64]bool),
+		outcomes: make(map[uint64]journalOutcome),
+		creating: make(map[string]bool),
+	}
+	j.changed = sync.NewCond(&j.Mutex)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.entry"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".entry"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected file in the journal: %s", file)
+		}
+		j.pending = append(j.pending, seq)
+	}
+
+	sort.Sort(bySeq(j.pending))
+
+	for _, seq := range j.pending {
+		entry, err := j.read(seq)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read journal entry %d: %v", seq, err)
+		}
+		if entry.Op == journalCreate {
+			j.creating[entry.Name] = true
+		}
+		j.next = seq + 1
+	}
+	j.depth = int64(len(j.pending))
+
+	return j, nil
+}
+
+type bySeq []uint64
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
+func (s bySeq) Less(a, b int) bool { return s[a] < s[b] }
+
+// Depth returns the number of writes in the journal which haven't been applied.
+func (j *JournaledStorage) Depth() int {
+	return int(atomic.LoadInt64(&j.depth))
+}
+
+// Replay applies the writes in the journal, stopping if storage is
+// unavailable, and returns the number which are left. If a write is already
+// being applied, that will carry on through the journal instead.
+func (j *JournaledStorage) Replay() int {
+	j.Lock()
+	defer j.Unlock()
+
+	if applied := j.replay(); applied > 0 {
+		j.logger.Infof("Replayed %d journaled writes, %d left", applied, len(j.pending))
+	}
+
+	return len(j.pending)
+}
+
+// Run replays the journal straight away and then every interval, until stop
+// is closed.
+func (j *JournaledStorage) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		j.Replay()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Create journals the creation of the named DataSet.
+func (j *JournaledStorage) Create(name string, cappedSize int64) error {
+	_, _, err := j.write(journalEntry{Op: journalCreate, Name: name, CappedSize: cappedSize})
+	return err
+}
+
+// Exists returns true if the named DataSet exists or its creation is waiting
+// in the journal. It returns false if storage is unavailable, so that the
+// creation is journaled too.
+func (j *JournaledStorage) Exists(name string) (exists bool, err error) {
+	j.Lock()
+	creating, unavailable := j.creating[name], j.unavailable
+	j.Unlock()
+
+	if creating {
+		return true, nil
+	}
+	if unavailable {
+		return false, nil
+	}
+
+	err = guard(func() (err error) {
+		exists, err = j.storage.Exists(name)
+		return
+	})
+	if _, ok := err.(unavailableError); ok {
+		j.Lock()
+		j.unavailable = true
+		j.Unlock()
+		return false, nil
+	}
+	return exists, err
+}
+
+// Empty journals emptying the named DataSet.
+func (j *JournaledStorage) Empty(name string) error {
+	_, _, err := j.write(journalEntry{Op: journalEmpty, Name: name})
+	return err
+}
+
+// Alive returns true if the storage can be reached.
+func (j *JournaledStorage) Alive() (alive bool) {
+	if err := guard(func() error { alive = j.storage.Alive(); return nil }); err != nil {
+		return false
+	}
+	return alive
+}
+
+// LastUpdated returns the time the named DataSet was last updated in storage,
+// ignoring any writes which are waiting in the journal.
+func (j *JournaledStorage) LastUpdated(name string) (*time.Time, error) {
+	return j.storage.LastUpdated(name)
+}
+
+// SaveRecords journals the records and then saves them. If storage is
+// unavailable the WriteResult only counts the records as Journaled.
+func (j *JournaledStorage) SaveRecords(name string, records []map[string]interface{}) (dataset.WriteResult, error) {
+	result, applied, err := j.write(journalEntry{Op: journalSave, Name: name, Records: records})
+	if !applied && err == nil {
+		result.Journaled = len(records)
+	}
+	return result, err
+}
+
+// Replace journals the records and then replaces the contents of the named
+// DataSet with them.
+func (j *JournaledStorage) Replace(name string, cappedSize int64, records []map[string]interface{}) error {
+	_, _, err := j.write(journalEntry{Op: journalReplace, Name: name, CappedSize: cappedSize, Records: records})
+	return err
+}
+
+// SaveVersions journals the records and then saves them, keeping the
+// versions they replace. If storage is unavailable the WriteResult only
+// counts the records as Journaled.
+func (j *JournaledStorage) SaveVersions(name string, records []map[string]interface{}, now time.Time) (dataset.WriteResult, error) {
+	result, applied, err := j.write(journalEntry{Op: journalVersion, Name: name, Records: records, Time: now})
+	if !applied && err == nil {
+		result.Journaled = len(records)
+	}
+	return result, err
+}
+
+// ReplaceVersions journals the records and then replaces the contents of the
+// named DataSet with them, keeping the versions they replace.
+func (j *JournaledStorage) ReplaceVersions(name string, cappedSize int64, records []map[string]interface{}, now time.Time) error {
+	_, _, err := j.write(journalEntry{Op: journalReplaceVersions, Name: name, CappedSize: cappedSize, Records: records, Time: now})
+	return err
+}
+
+// DeleteRecords removes the records in the named DataSet which match filter.
+// Records can't be deleted while there are writes in the journal, because
+// until they have been applied it isn't known which records would match.
+func (j *JournaledStorage) DeleteRecords(name string, filter dataset.RecordFilter) (deleted int, err error) {
+	err = j.remove(name, func() (err error) {
+		deleted, err = j.storage.DeleteRecords(name, filter)
+		return
+	})
+	return deleted, err
+}
+
+// RetireRecords removes the records in the named DataSet which match filter,
+// keeping them as earlier versions. Like DeleteRecords, it can't be used while
+// there are writes in the journal.
+func (j *JournaledStorage) RetireRecords(name string, filter dataset.RecordFilter, now time.Time) (retired int, err error) {
+	err = j.remove(name, func() (err error) {
+		storage, ok := j.storage.(dataset.VersionedStorage)
+		if !ok {
+			return fmt.Errorf("Unable to keep earlier versions of the records in %s", name)
+		}
+		retired, err = storage.RetireRecords(name, filter, now)
+		return
+	})
+	return retired, err
+}
+
+// DeleteVersions removes the earlier versions of records in the named DataSet
+// which match filter. Like DeleteRecords, it can't be used while there are
+// writes in the journal.
+func (j *JournaledStorage) DeleteVersions(name string, filter dataset.RecordFilter) (deleted int, err error) {
+	err = j.remove(name, func() (err error) {
+		storage, ok := j.storage.(dataset.VersionedStorage)
+		if !ok {
+			return fmt.Errorf("Unable to remove earlier versions of the records in %s", name)
+		}
+		deleted, err = storage.DeleteVersions(name, filter)
+		return
+	})
+	return deleted, err
+}
+
+// remove calls f to remove records from the named DataSet once the journal has
+// been replayed, rather than journaling it, because the number of records
+// removed is needed straight away. Writes journaled meanwhile wait for it.
+func (j *JournaledStorage) remove(name string, f func() error) error {
+	j.Lock()
+	defer j.Unlock()
+
+	for j.inFlight != 0 || (len(j.pending) > 0 && !j.unavailable) {
+		if j.inFlight == 0 {
+			j.replay()
+		} else {
+			j.changed.Wait()
+		}
+	}
+
+	if len(j.pending) > 0 {
+		return fmt.Errorf("Unable to delete records from %s while %d writes are waiting to be applied", name, len(j.pending))
+	}
+
+	j.inFlight = removing
+	j.Unlock()
+	err := guard(f)
+	j.Lock()
+	j.inFlight = 0
+	j.changed.Broadcast()
+
+	if _, ok := err.(unavailableError); ok {
+		j.unavailable = true
+	}
+
+	return err
+}
+
+// CountRecords counts the records in the named DataSet which match filter,
+// ignoring any writes which are waiting in the journal.
+func (j *JournaledStorage) CountRecords(name string, filter dataset.RecordFilter) (int, error) {
+	return j.storage.CountRecords(name, filter)
+}
+
+// FindRecords finds the records in the named DataSet which match filter,
+// ignoring any writes which are waiting in the journal.
+func (j *JournaledStorage) FindRecords(name string, filter dataset.RecordFilter, limit int) ([]map[string]interface{}, error) {
+	return j.storage.FindRecords(name, filter, limit)
+}
+
+// write journals entry and then waits for it to be applied, along with any
+// writes journaled before it. If storage is known to be unavailable, entry is
+// only journaled rather than making the request wait to find that out again.
+func (j *JournaledStorage) write(entry journalEntry) (result dataset.WriteResult, applied bool, err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry.Seq = j.next
+	if err := j.append(entry); err != nil {
+		return result, false, fmt.Errorf("Unable to journal the write to %s: %v", entry.Name, err)
+	}
+	j.next++
+	j.pending = append(j.pending, entry.Seq)
+	atomic.AddInt64(&j.depth, 1)
+
+	j.waiting[entry.Seq] = true
+	defer delete(j.waiting, entry.Seq)
+
+	for {
+		if outcome, ok := j.outcomes[entry.Seq]; ok {
+			delete(j.outcomes, entry.Seq)
+			return outcome.result, true, outcome.err
+		}
+
+		if j.unavailable {
+			if entry.Op == journalCreate {
+				j.creating[entry.Name] = true
+			}
+			return result, false, nil
+		}
+
+		if j.inFlight == 0 {
+			j.replay()
+		} else {
+			j.changed.Wait()
+		}
+	}
+}
+
+// replay applies the journaled writes in order until one can't be applied
+// because storage is unavailable, and returns how many were applied. It must
+// be called with the lock held, which it releases while each write is in
+// flight; if another write is already in flight it returns straight away.
+// The outcome of a write is kept for the request waiting for it, otherwise
+// writes which storage rejects are logged. Either way they are removed from
+// the journal.
+func (j *JournaledStorage) replay() (applied int) {
+	if j.inFlight != 0 {
+		return 0
+	}
+
+	for len(j.pending) > 0 {
+		next := j.pending[0]
+		j.inFlight = next
+		j.Unlock()
+
+		entry, err := j.read(next)
+		var result dataset.WriteResult
+		if err != nil {
+			err = fmt.Errorf("Unable to read journal entry %d: %v", next, err)
+		} else {
+			result, err = j.apply(entry)
+		}
+
+		j.Lock()
+		j.inFlight = 0
+		j.changed.Broadcast()
+
+		if _, ok := err.(unavailableError); ok {
+			j.unavailable = true
+			return applied
+		}
+		j.unavailable = false
+
+		if removeErr := os.Remove(j.path(next)); removeErr != nil {
+			j.logger.WithField("entry", next).Errorf("Unable to remove applied journal entry: %v", removeErr)
+		}
+		j.pending = j.pending[1:]
+		atomic.AddInt64(&j.depth, -1)
+		applied++
+		if entry.Op == journalCreate {
+			delete(j.creating, entry.Name)
+		}
+
+		if j.waiting[next] {
+			j.outcomes[next] = journalOutcome{result, err}
+		} else if err != nil {
+			j.logger.WithFields(logrus.Fields{
+				"entry":   next,
+				"dataset": entry.Name,
+				"op":      entry.Op}).Errorf("Unable to apply journaled write: %v", err)
+			StatsdClient.Incr("journal.error."+entry.Name, 1)
+		}
+	}
+
+	return applied
+}
+
+func (j *JournaledStorage) apply(entry journalEntry) (result dataset.WriteResult, err error) {
+	err = guard(func() (err error) {
+		switch entry.Op {
+		case journalCreate:
+			var exists bool
+			if exists, err = j.storage.Exists(entry.Name); err == nil && !exists {
+				err = j.storage.Create(entry.Name, entry.CappedSize)
+			}
+		case journalSave:
+			result, err = j.storage.SaveRecords(entry.Name, entry.Records)
+		case journalReplace:
+			err = j.storage.Replace(entry.Name, entry.CappedSize, entry.Records)
+		case journalEmpty:
+			err = j.storage.Empty(entry.Name)
+		case journalVersion:
+			storage, ok := j.storage.(dataset.VersionedStorage)
+			if !ok {
+				return fmt.Errorf("Unable to keep earlier versions of the records in %s", entry.Name)
+			}
+			result, err = storage.SaveVersions(entry.Name, entry.Records, entry.Time)
+		case journalReplaceVersions:
+			storage, ok := j.storage.(dataset.VersionedStorage)
+			if !ok {
+				return fmt.Errorf("Unable to keep earlier versions of the records in %s", entry.Name)
+			}
+			err = storage.ReplaceVersions(entry.Name, entry.CappedSize, entry.Records, entry.Time)
+		default:
+			err = fmt.Errorf("Unknown journal operation %q", entry.Op)
+		}
+		return
+	})
+	return
+}
+
+func (j *JournaledStorage) path(seq uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d.entry", seq))
+}
+
+// append writes entry to a temporary file, syncs it and renames it into
+// place, so that the journal never holds a partial write.
+func (j *JournaledStorage) append(entry journalEntry) error {
+	temp := j.path(entry.Seq) + ".tmp"
+	f, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(entry)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return os.Rename(temp, j.path(entry.Seq))
+}
+
+func (j *JournaledStorage) read(seq uint64) (entry journalEntry, err error) {
+	f, err := os.Open(j.path(seq))
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&entry)
+	return
+}
+
+// guard calls f, turning an error caused by not being able to reach storage
+// into an unavailableError. A panic is returned as an error, so that the write
+// fails rather than being retried forever, unless it too is a connection
+// failure.
+func guard(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("storage panicked: %v", r)
+			if cause, ok := r.(error); ok && isUnavailable(cause) {
+				err = unavailableError{r}
+			}
+		}
+	}()
+
+	if err = f(); err != nil && isUnavailable(err) {
+		err = unavailableError{err}
+	}
+	return
+}
+
+// isUnavailable reports whether err means storage couldn't be reached.
+func isUnavailable(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "no reachable servers") || strings.Contains(message, "Closed explicitly")
+}
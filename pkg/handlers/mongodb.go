@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/alphagov/performance-datastore/pkg/utils"
 	"github.com/hashicorp/errwrap"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -13,33 +18,60 @@ var (
 	mgoSession *mgo.Session
 )
 
+// retireBatchSize is the most records RetireRecords moves into a history at once.
+const retireBatchSize = 1000
+
 // MongoDataSetStorage is an implementation of DataSetStorage.
 type MongoDataSetStorage struct {
 	URL          string
 	DatabaseName string
+	// UnorderedWrites lets Mongo apply the records in a bulk write in any order,
+	// which is faster but means we can't tell which record caused a failure.
+	UnorderedWrites bool
 }
 
-func getMgoSession(URL string) *mgo.Session {
+// MongoOption is a self-referential function used to configure a MongoDataSetStorage.
+// See http://commandcenter.blogspot.com.au/2014/01/self-referential-functions-and-design.html
+type MongoOption func(*MongoDataSetStorage) MongoOption
+
+func getMgoSession(URL string) (*mgo.Session, error) {
 	if mgoSession == nil {
-		var err error
-		mgoSession, err = mgo.DialWithTimeout(URL, 5*time.Second)
+		session, err := mgo.DialWithTimeout(URL, 5*time.Second)
 		if err != nil {
-			panic(errwrap.Wrapf("Unable to connect: {{err}}", err))
+			return nil, errwrap.Wrapf("Unable to connect: {{err}}", err)
 		}
 		// Set timeout to suitably small value by default.
-		mgoSession.SetSyncTimeout(5 * time.Second)
+		session.SetSyncTimeout(5 * time.Second)
+		mgoSession = session
 	}
-	return mgoSession.Copy()
+	return mgoSession.Copy(), nil
 }
 
 // NewMongoStorage creates a new MongoDataSetStorage.
-func NewMongoStorage(URL string, databaseName string) dataset.DataSetStorage {
-	return &MongoDataSetStorage{URL, databaseName}
+// Optional MongoOption arguments can be passed to tweak its behaviour. See UnorderedWrites.
+func NewMongoStorage(URL string, databaseName string, options ...MongoOption) dataset.DataSetStorage {
+	storage := &MongoDataSetStorage{URL: URL, DatabaseName: databaseName}
+	for _, option := range options {
+		option(storage)
+	}
+	return storage
+}
+
+// UnorderedWrites specifies whether bulk writes of records may be applied out of order. The default value is false.
+func UnorderedWrites(unordered bool) MongoOption {
+	return func(m *MongoDataSetStorage) MongoOption {
+		previous := m.UnorderedWrites
+		m.UnorderedWrites = unordered
+		return UnorderedWrites(previous)
+	}
 }
 
 // Create creates the named DataSet, returning an error if there was a problem.
 func (m *MongoDataSetStorage) Create(name string, cappedSize int64) error {
-	session := getMgoSession(m.URL)
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return err
+	}
 	defer session.Close()
 
 	info := &mgo.CollectionInfo{}
@@ -53,28 +85,34 @@ func (m *MongoDataSetStorage) Create(name string, cappedSize int64) error {
 }
 
 // Exists returns true if the named DataSet exists, otherwise false.
-func (m *MongoDataSetStorage) Exists(name string) bool {
-	session := getMgoSession(m.URL)
+func (m *MongoDataSetStorage) Exists(name string) (bool, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return false, err
+	}
 	defer session.Close()
 
 	names, err := session.DB(m.DatabaseName).CollectionNames()
 
 	if err != nil {
-		panic(errwrap.Wrapf("DataSet <"+name+"> doesn't exist in <"+m.DatabaseName+">: {{err}}", err))
+		return false, errwrap.Wrapf("Unable to list the data sets in <"+m.DatabaseName+">: {{err}}", err)
 	}
 
 	for _, n := range names {
 		if n == name {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
 
 // Alive returns true if we can talk to a mongodb instance, otherwise false
 func (m *MongoDataSetStorage) Alive() bool {
-	session := getMgoSession(m.URL)
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return false
+	}
 	defer session.Close()
 
 	session.SetMode(mgo.Eventual, true)
@@ -84,36 +122,40 @@ func (m *MongoDataSetStorage) Alive() bool {
 
 // Empty empties the named DataSet.
 func (m *MongoDataSetStorage) Empty(name string) error {
-	session := getMgoSession(m.URL)
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return err
+	}
 	defer session.Close()
 	session.SetMode(mgo.Monotonic, true)
 
 	coll := session.DB(m.DatabaseName).C(name)
-	_, err := coll.RemoveAll(nil)
+	_, err = coll.RemoveAll(nil)
 	return err
 }
 
 // LastUpdated returns the time that the named DataSet was last updated, or nil if it never has been updated.
-func (m *MongoDataSetStorage) LastUpdated(name string) (t *time.Time) {
-	session := getMgoSession(m.URL)
+func (m *MongoDataSetStorage) LastUpdated(name string) (t *time.Time, err error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return nil, errwrap.Wrapf("Problem reading dataset <"+name+"> in <"+m.DatabaseName+">: {{err}}", err)
+	}
 	defer session.Close()
 	session.SetMode(mgo.Monotonic, true)
 
 	var lastUpdated bson.M
 
 	coll := session.DB(m.DatabaseName).C(name)
-	err := coll.Find(nil).Sort("-_updated_at").One(&lastUpdated)
+	err = coll.Find(nil).Sort("-_updated_at").One(&lastUpdated)
 
 	if err == mgo.ErrNotFound {
-		return nil
+		return nil, nil
 	}
 
 	if err != nil {
-		panic(errwrap.Wrapf("Problem reading dataset <"+name+"> in <"+m.DatabaseName+">: {{err}}", err))
+		return nil, errwrap.Wrapf("Problem reading dataset <"+name+"> in <"+m.DatabaseName+">: {{err}}", err)
 	}
 
-	t = nil
-
 	value, isTime := lastUpdated["_updated_at"].(time.Time)
 
 	if isTime {
@@ -123,11 +165,679 @@ func (m *MongoDataSetStorage) LastUpdated(name string) (t *time.Time) {
 	return
 }
 
-// SaveRecord saves the given JSON record in the named DataSet, returning an error if there was a problem.
-func (m *MongoDataSetStorage) SaveRecord(name string, record map[string]interface{}) error {
-	session := getMgoSession(m.URL)
+// SaveRecords saves the given JSON records in the named DataSet using a single bulk write, returning an error if there was a problem.
+// Records with an _id are upserted, replacing any existing record with that _id.
+// Mongo has no transactions, so if the bulk write fails then the records it
+// wrote are removed and the records they replaced are restored.
+func (m *MongoDataSetStorage) SaveRecords(name string, records []map[string]interface{}) (dataset.WriteResult, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return dataset.WriteResult{}, err
+	}
 	defer session.Close()
 	coll := session.DB(m.DatabaseName).C(name)
 
-	return coll.Insert(record)
+	previous, err := findExisting(coll, records)
+	if err != nil {
+		return dataset.WriteResult{}, errwrap.Wrapf("Unable to read existing records, no records were written: {{err}}", err)
+	}
+
+	result := countWrites(records, previous)
+
+	if err := m.writeRecords(coll, records); err != nil {
+		return dataset.WriteResult{}, rollback(coll, records, previous, err)
+	}
+
+	return result, nil
+}
+
+// Replace atomically replaces the contents of the named DataSet with records.
+// The records are loaded into a staging collection, with the same indexes as
+// the existing collection, which is then renamed over the top of the existing
+// collection, so readers never see a partial DataSet.
+func (m *MongoDataSetStorage) Replace(name string, cappedSize int64, records []map[string]interface{}) error {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	db := session.DB(m.DatabaseName)
+	staging, err := m.stage(db, name, cappedSize, records)
+	if err != nil {
+		return err
+	}
+
+	return swap(db, staging, name)
+}
+
+// ReplaceVersions replaces the contents of the named DataSet like Replace,
+// but first copies the records being replaced into its history, as valid
+// until now. The copies are removed again if the replacement fails, so the
+// DataSet and its history are left as they were.
+func (m *MongoDataSetStorage) ReplaceVersions(name string, cappedSize int64, records []map[string]interface{}, now time.Time) error {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	db := session.DB(m.DatabaseName)
+	staging, err := m.stage(db, name, cappedSize, records)
+	if err != nil {
+		return err
+	}
+
+	history := db.C(historyName(name))
+	ids, err := copyToHistory(db.C(name), history, now)
+	if err != nil {
+		staging.DropCollection()
+		removeVersionIDs(history, ids)
+		return errwrap.Wrapf("Unable to keep the records being replaced, no records were replaced: {{err}}", err)
+	}
+
+	if err := swap(db, staging, name); err != nil {
+		removeVersionIDs(history, ids)
+		return err
+	}
+
+	return nil
+}
+
+// stage loads records into a new staging collection for the named DataSet,
+// with the same indexes as the DataSet's collection.
+func (m *MongoDataSetStorage) stage(db *mgo.Database, name string, cappedSize int64, records []map[string]interface{}) (*mgo.Collection, error) {
+	// Each replacement has its own staging collection, so that concurrent
+	// replacements of the same DataSet can't interfere with each other
+	staging := db.C(name + "_staging_" + bson.NewObjectId().Hex())
+
+	info := &mgo.CollectionInfo{}
+	if cappedSize != 0 {
+		info.MaxBytes = int(cappedSize)
+		info.Capped = true
+	}
+
+	if err := staging.Create(info); err != nil {
+		return nil, err
+	}
+
+	// renameCollection with dropTarget throws away the target's indexes
+	if err := copyIndexes(db.C(name), staging); err != nil {
+		staging.DropCollection()
+		return nil, errwrap.Wrapf("Unable to copy the indexes of <"+name+">: {{err}}", err)
+	}
+
+	if err := m.writeRecords(staging, records); err != nil {
+		staging.DropCollection()
+		return nil, errwrap.Wrapf("Unable to stage records for <"+name+">: {{err}}", err)
+	}
+
+	return staging, nil
+}
+
+// swap renames staging over the top of the named collection, dropping
+// staging if it can't be.
+func swap(db *mgo.Database, staging *mgo.Collection, name string) error {
+	err := db.Session.DB("admin").Run(bson.D{
+		{Name: "renameCollection", Value: staging.FullName},
+		{Name: "to", Value: db.C(name).FullName},
+		{Name: "dropTarget", Value: true}}, nil)
+
+	if err != nil {
+		staging.DropCollection()
+		return errwrap.Wrapf("Unable to replace <"+name+">: {{err}}", err)
+	}
+
+	return nil
+}
+
+// copyIndexes creates the indexes of from, other than the _id index which
+// every collection has, on to. A from which doesn't exist has no indexes.
+func copyIndexes(from *mgo.Collection, to *mgo.Collection) error {
+	indexes, err := from.Indexes()
+	if err != nil {
+		if isNamespaceNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, index := range indexes {
+		if index.Name == "_id_" {
+			continue
+		}
+		if err := to.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteRecords removes the records in the named DataSet which match filter, returning how many were removed.
+func (m *MongoDataSetStorage) DeleteRecords(name string, filter dataset.RecordFilter) (int, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	info, err := session.DB(m.DatabaseName).C(name).RemoveAll(newFilterQuery(filter))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Removed, nil
+}
+
+// CountRecords returns how many records in the named DataSet match filter.
+// If filter has an AsOf time, the earlier versions in the DataSet's history
+// which were valid then are counted too.
+func (m *MongoDataSetStorage) CountRecords(name string, filter dataset.RecordFilter) (int, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	session.SetMode(mgo.Monotonic, true)
+
+	db := session.DB(m.DatabaseName)
+
+	if filter.AsOf == nil {
+		return db.C(name).Find(newFilterQuery(filter)).Count()
+	}
+
+	current, err := db.C(name).Find(newAsOfQuery(filter, false)).Count()
+	if err != nil {
+		return 0, err
+	}
+
+	earlier, err := db.C(historyName(name)).Find(newAsOfQuery(filter, true)).Count()
+	if err != nil {
+		return 0, err
+	}
+
+	return current + earlier, nil
+}
+
+// FindRecords returns at most limit of the records in the named DataSet which
+// match filter. If filter has an AsOf time, the earlier versions in the
+// DataSet's history which were valid then are found too, with the _id of the
+// record they are a version of.
+func (m *MongoDataSetStorage) FindRecords(name string, filter dataset.RecordFilter, limit int) ([]map[string]interface{}, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	session.SetMode(mgo.Monotonic, true)
+
+	db := session.DB(m.DatabaseName)
+
+	query := newFilterQuery(filter)
+	if filter.AsOf != nil {
+		query = newAsOfQuery(filter, false)
+	}
+
+	var current []bson.M
+	if err := db.C(name).Find(query).Sort("_id").Limit(limit).All(&current); err != nil {
+		return nil, err
+	}
+
+	var earlier []bson.M
+	if filter.AsOf != nil && len(current) < limit {
+		err := db.C(historyName(name)).Find(newAsOfQuery(filter, true)).
+			Sort("_record_id").Limit(limit - len(current)).All(&earlier)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]map[string]interface{}, 0, len(current)+len(earlier))
+	for _, record := range current {
+		records = append(records, record)
+	}
+	for _, version := range earlier {
+		records = append(records, asRecord(version))
+	}
+	return records, nil
+}
+
+// SaveVersions saves the records like SaveRecords, but first copies the
+// records they replace into the DataSet's history, as valid until now.
+func (m *MongoDataSetStorage) SaveVersions(name string, records []map[string]interface{}, now time.Time) (dataset.WriteResult, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return dataset.WriteResult{}, err
+	}
+	defer session.Close()
+	db := session.DB(m.DatabaseName)
+	coll := db.C(name)
+
+	previous, err := findExisting(coll, records)
+	if err != nil {
+		return dataset.WriteResult{}, errwrap.Wrapf("Unable to read existing records, no records were written: {{err}}", err)
+	}
+
+	history := db.C(historyName(name))
+	versions := newHistoryRecords(previous, now)
+	if err := insertVersions(history, versions); err != nil {
+		return dataset.WriteResult{}, errwrap.Wrapf("Unable to keep the earlier versions of records, no records were written: {{err}}", err)
+	}
+
+	result := countWrites(records, previous)
+
+	if err := m.writeRecords(coll, records); err != nil {
+		removeVersions(history, versions)
+		return dataset.WriteResult{}, rollback(coll, records, previous, err)
+	}
+
+	return result, nil
+}
+
+// RetireRecords moves the records in the named DataSet which match filter
+// into its history, as valid until now, returning how many were moved. The
+// records are moved in batches of retireBatchSize, so if an error is returned
+// the batches before it have already been moved.
+func (m *MongoDataSetStorage) RetireRecords(name string, filter dataset.RecordFilter, now time.Time) (int, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	db := session.DB(m.DatabaseName)
+	coll := db.C(name)
+	history := db.C(historyName(name))
+
+	retired := 0
+	batch := make([]bson.M, 0, retireBatchSize)
+	iter := coll.Find(newFilterQuery(filter)).Batch(retireBatchSize).Iter()
+
+	var record bson.M
+	for iter.Next(&record) {
+		batch = append(batch, record)
+		record = nil
+
+		if len(batch) < retireBatchSize {
+			continue
+		}
+
+		removed, err := retireBatch(coll, history, batch, now)
+		retired += removed
+		if err != nil {
+			iter.Close()
+			return retired, err
+		}
+		batch = batch[:0]
+	}
+
+	if err := iter.Close(); err != nil {
+		return retired, err
+	}
+
+	removed, err := retireBatch(coll, history, batch, now)
+	return retired + removed, err
+}
+
+// DeleteVersions removes the versions in the named DataSet's history which
+// match filter, returning how many were removed.
+func (m *MongoDataSetStorage) DeleteVersions(name string, filter dataset.RecordFilter) (int, error) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	info, err := session.DB(m.DatabaseName).C(historyName(name)).RemoveAll(newFilterQuery(filter))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Removed, nil
+}
+
+// retireBatch copies records into history and then removes them from coll,
+// returning how many were removed.
+func retireBatch(coll, history *mgo.Collection, records []bson.M, now time.Time) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	versions := newHistoryRecords(records, now)
+	if err := insertVersions(history, versions); err != nil {
+		return 0, errwrap.Wrapf("Unable to keep the records being removed, no more records were removed: {{err}}", err)
+	}
+
+	ids := make([]interface{}, len(records))
+	for i, record := range records {
+		ids[i] = record["_id"]
+	}
+
+	info, err := coll.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Removed, nil
+}
+
+// copyToHistory copies every record in coll into history, in batches of
+// retireBatchSize, as versions which were valid until now. It returns the
+// _ids of the versions it inserted, even if it fails part way.
+func copyToHistory(coll, history *mgo.Collection, now time.Time) ([]interface{}, error) {
+	var ids []interface{}
+	batch := make([]bson.M, 0, retireBatchSize)
+
+	insert := func() error {
+		versions := newHistoryRecords(batch, now)
+		if err := insertVersions(history, versions); err != nil {
+			return err
+		}
+		for _, version := range versions {
+			ids = append(ids, version["_id"])
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	iter := coll.Find(nil).Batch(retireBatchSize).Iter()
+
+	var record bson.M
+	for iter.Next(&record) {
+		batch = append(batch, record)
+		record = nil
+
+		if len(batch) == retireBatchSize {
+			if err := insert(); err != nil {
+				iter.Close()
+				return ids, err
+			}
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return ids, err
+	}
+
+	return ids, insert()
+}
+
+// historyName is the name of the collection which keeps the earlier versions
+// of the records in the named DataSet. DataSet names never contain a dot, so
+// it can't be the name of another DataSet.
+func historyName(name string) string {
+	return name + ".history"
+}
+
+// newHistoryRecords returns copies of records to keep as versions which were
+// valid until validTo. Each version has its own _id, and the _id of the record
+// it is a version of in _record_id.
+func newHistoryRecords(records []bson.M, validTo time.Time) []bson.M {
+	versions := make([]bson.M, len(records))
+	for i, record := range records {
+		version := bson.M{}
+		for k, v := range record {
+			version[k] = v
+		}
+		version["_id"] = bson.NewObjectId()
+		version["_record_id"] = record["_id"]
+		version["_valid_to"] = validTo
+		versions[i] = version
+	}
+	return versions
+}
+
+// asRecord returns the record which version was a version of, as it was
+// then. It keeps its _valid_to, so that it can be told apart from a record
+// which is still current.
+func asRecord(version bson.M) map[string]interface{} {
+	record := map[string]interface{}{}
+	for k, v := range version {
+		record[k] = v
+	}
+	record["_id"] = version["_record_id"]
+	delete(record, "_record_id")
+	return record
+}
+
+// insertVersions inserts versions into the history, removing any which were
+// inserted if they can't all be.
+func insertVersions(history *mgo.Collection, versions []bson.M) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(versions))
+	for i, version := range versions {
+		docs[i] = version
+	}
+
+	if err := history.Insert(docs...); err != nil {
+		removeVersions(history, versions)
+		return err
+	}
+	return nil
+}
+
+func removeVersions(history *mgo.Collection, versions []bson.M) {
+	ids := make([]interface{}, len(versions))
+	for i, version := range versions {
+		ids[i] = version["_id"]
+	}
+	removeVersionIDs(history, ids)
+}
+
+// removeVersionIDs removes the versions with the given _ids from history, in
+// batches of retireBatchSize.
+func removeVersionIDs(history *mgo.Collection, ids []interface{}) {
+	for len(ids) > 0 {
+		n := retireBatchSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		history.RemoveAll(bson.M{"_id": bson.M{"$in": ids[:n]}})
+		ids = ids[n:]
+	}
+}
+
+// newAsOfQuery selects the records which match filter and were valid at its
+// AsOf time, either from a DataSet or from its history. Records written
+// before the DataSet was versioned have no _valid_from, and count as valid
+// from the start.
+func newAsOfQuery(filter dataset.RecordFilter, history bool) bson.M {
+	query := newFilterQuery(filter)
+	if history && filter.ID != "" {
+		query = bson.M{"_record_id": filter.ID}
+	}
+
+	query["$or"] = []bson.M{
+		{"_valid_from": bson.M{"$lte": *filter.AsOf}},
+		{"_valid_from": bson.M{"$exists": false}}}
+
+	if history {
+		query["_valid_to"] = bson.M{"$gt": *filter.AsOf}
+	}
+
+	return query
+}
+
+func newFilterQuery(filter dataset.RecordFilter) bson.M {
+	if filter.ID != "" {
+		return bson.M{"_id": filter.ID}
+	}
+
+	query := bson.M{}
+	// Sorted, so the same filter always gives the same query
+	keys := make([]string, 0, len(filter.FilterBy))
+	for k := range filter.FilterBy {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var conditions []bson.M
+	for _, k := range keys {
+		for _, v := range filter.FilterBy[k] {
+			conditions = append(conditions, bson.M{k: bson.M{"$in": filterValues(v)}})
+		}
+	}
+	if len(conditions) == 1 {
+		query = conditions[0]
+	} else if len(conditions) > 1 {
+		query["$and"] = conditions
+	}
+
+	timestamp := bson.M{}
+	if filter.StartAt != nil {
+		timestamp["$gte"] = *filter.StartAt
+	}
+	if filter.EndAt != nil {
+		timestamp["$lt"] = *filter.EndAt
+	}
+	if len(timestamp) > 0 {
+		query["_timestamp"] = timestamp
+	}
+
+	return query
+}
+
+// filterValues returns the values which a filter_by value given as text can
+// match: the text itself, and the number or boolean it is the text of. Integers
+// match as float64 too, since that's how they were stored before they were
+// decoded as int64.
+func filterValues(text string) []interface{} {
+	values := []interface{}{text}
+
+	if n, err := utils.ParseNumber(text); err == nil {
+		values = append(values, n)
+		if i, isInt := n.(int64); isInt {
+			values = append(values, float64(i))
+		}
+	}
+
+	switch text {
+	case "true":
+		values = append(values, true)
+	case "false":
+		values = append(values, false)
+	}
+
+	return values
+}
+
+// findExisting returns the stored versions of any records which will be replaced.
+func findExisting(coll *mgo.Collection, records []map[string]interface{}) ([]bson.M, error) {
+	var ids []interface{}
+	for _, record := range records {
+		if id, hasID := record["_id"]; hasID {
+			ids = append(ids, id)
+		}
+	}
+
+	var existing []bson.M
+	if len(ids) == 0 {
+		return existing, nil
+	}
+
+	err := coll.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&existing)
+	return existing, err
+}
+
+// rollback undoes a failed SaveRecords by removing any records which were
+// written and restoring the ones they replaced.
+func rollback(coll *mgo.Collection, written []map[string]interface{}, previous []bson.M, cause error) error {
+	ids := make([]interface{}, len(written))
+	for i, record := range written {
+		ids[i] = record["_id"]
+	}
+
+	rollbackFailed := func(err error) error {
+		return fmt.Errorf("%v and rolling back failed, some records may have been written: %v", describeBulkError(cause), err)
+	}
+
+	if _, err := coll.RemoveAll(bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return rollbackFailed(err)
+	}
+
+	for _, record := range previous {
+		if err := coll.Insert(record); err != nil {
+			return rollbackFailed(err)
+		}
+	}
+
+	return fmt.Errorf("%v, no records were written", describeBulkError(cause))
+}
+
+// describeBulkError says which records a bulk write failed on, if Mongo told us.
+func describeBulkError(err error) string {
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return err.Error()
+	}
+
+	var indexes []string
+	for _, c := range bulkErr.Cases() {
+		if c.Index >= 0 {
+			indexes = append(indexes, strconv.Itoa(c.Index))
+		}
+	}
+
+	if len(indexes) == 0 {
+		return bulkErr.Error()
+	}
+
+	return fmt.Sprintf("records [%s] could not be saved: %v", strings.Join(indexes, ", "), strings.TrimSpace(bulkErr.Error()))
+}
+
+// writeRecords queues every record onto a single bulk write. Records without
+// an _id are given one so that they can be rolled back if necessary.
+func (m *MongoDataSetStorage) writeRecords(coll *mgo.Collection, records []map[string]interface{}) error {
+	bulk := coll.Bulk()
+	if m.UnorderedWrites {
+		bulk.Unordered()
+	}
+
+	for _, record := range records {
+		if id, hasID := record["_id"]; hasID {
+			bulk.Upsert(bson.M{"_id": id}, record)
+		} else {
+			record["_id"] = bson.NewObjectId()
+			bulk.Insert(record)
+		}
+	}
+
+	_, err := bulk.Run()
+	return err
+}
+
+// countWrites works out how many records will be inserted and how many will
+// replace an existing record. Mongo's bulk results count upserts as matches,
+// so we can't rely on them for this.
+func countWrites(records []map[string]interface{}, previous []bson.M) (result dataset.WriteResult) {
+	seen := make(map[interface{}]bool, len(previous))
+	for _, record := range previous {
+		seen[record["_id"]] = true
+	}
+
+	for _, record := range records {
+		id, hasID := record["_id"]
+		if hasID && seen[id] {
+			result.Updated++
+			continue
+		}
+		if hasID {
+			seen[id] = true
+		}
+		result.Inserted++
+	}
+
+	return
+}
+
+// namespaceNotFound is the code of the error Mongo returns for a collection
+// which doesn't exist.
+const namespaceNotFound = 26
+
+func isNamespaceNotFound(err error) bool {
+	queryErr, ok := err.(*mgo.QueryError)
+	return ok && queryErr.Code == namespaceNotFound
 }
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alphagov/performance-datastore/pkg/config"
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/alphagov/performance-datastore/pkg/utils"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The benchmarks in this file compare writing a 10k record upload one record
+// at a time with writing it in a single bulk operation. They need a running
+// Mongo, so are skipped unless MONGO_URL is set, eg:
+//
+//   MONGO_URL=localhost gom test -run NONE -bench SaveRecords ./pkg/handlers/
+
+const benchmarkRecordCount = 10000
+
+func newBenchmarkStorage(b *testing.B, options ...MongoOption) *MongoDataSetStorage {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		b.Skip("MONGO_URL is not set")
+	}
+	return NewMongoStorage(url, "performance_datastore_benchmark", options...).(*MongoDataSetStorage)
+}
+
+func newBenchmarkRecords(withIDs bool) []map[string]interface{} {
+	records := make([]map[string]interface{}, benchmarkRecordCount)
+	now := time.Now()
+	for i := range records {
+		records[i] = map[string]interface{}{
+			"_timestamp":  now,
+			"_updated_at": now,
+			"animal":      "parrot",
+			"count":       float64(i),
+		}
+		if withIDs {
+			records[i]["_id"] = fmt.Sprintf("record-%d", i)
+		}
+	}
+	return records
+}
+
+func dropBenchmarkCollection(b *testing.B, m *MongoDataSetStorage, name string) {
+	session, err := getMgoSession(m.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer session.Close()
+	session.DB(m.DatabaseName).C(name).DropCollection()
+}
+
+// benchmarkOneAtATime is how records were written before SaveRecords used bulk writes.
+func benchmarkOneAtATime(b *testing.B, withIDs bool) {
+	m := newBenchmarkStorage(b)
+	defer dropBenchmarkCollection(b, m, "one_at_a_time")
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		dropBenchmarkCollection(b, m, "one_at_a_time")
+		records := newBenchmarkRecords(withIDs)
+		b.StartTimer()
+
+		for _, record := range records {
+			session, err := getMgoSession(m.URL)
+			if err != nil {
+				b.Fatal(err)
+			}
+			coll := session.DB(m.DatabaseName).C("one_at_a_time")
+			if id, hasID := record["_id"]; hasID {
+				_, err = coll.UpsertId(id, record)
+			} else {
+				err = coll.Insert(record)
+			}
+			session.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func benchmarkSaveRecords(b *testing.B, withIDs bool, options ...MongoOption) {
+	m := newBenchmarkStorage(b, options...)
+	defer dropBenchmarkCollection(b, m, "bulk")
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		dropBenchmarkCollection(b, m, "bulk")
+		records := newBenchmarkRecords(withIDs)
+		b.StartTimer()
+
+		if _, err := m.SaveRecords("bulk", records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveRecordsOneAtATime(b *testing.B) {
+	benchmarkOneAtATime(b, false)
+}
+
+func BenchmarkSaveRecordsBulkOrdered(b *testing.B) {
+	benchmarkSaveRecords(b, false)
+}
+
+func BenchmarkSaveRecordsBulkUnordered(b *testing.B) {
+	benchmarkSaveRecords(b, false, UnorderedWrites(true))
+}
+
+func BenchmarkSaveRecordsWithIDsOneAtATime(b *testing.B) {
+	benchmarkOneAtATime(b, true)
+}
+
+func BenchmarkSaveRecordsWithIDsBulkOrdered(b *testing.B) {
+	benchmarkSaveRecords(b, true)
+}
+
+func BenchmarkSaveRecordsWithIDsBulkUnordered(b *testing.B) {
+	benchmarkSaveRecords(b, true, UnorderedWrites(true))
+}
+
+var _ = Describe("MongoDataSetStorage", func() {
+	Describe("Counting writes", func() {
+		It("Should count records replacing an existing _id as updates", func() {
+			records := []map[string]interface{}{
+				{"_id": "existing"},
+				{"_id": "new"},
+				{"_id": "new"},
+				{"animal": "parrot"},
+			}
+			previous := []bson.M{{"_id": "existing"}}
+
+			Expect(countWrites(records, previous)).Should(Equal(dataset.WriteResult{Inserted: 2, Updated: 2}))
+		})
+	})
+
+	Describe("Filtering", func() {
+		It("Should match filter_by values as text, numbers and booleans", func() {
+			query := newFilterQuery(dataset.RecordFilter{FilterBy: map[string][]string{
+				"count":    {"3"},
+				"finished": {"true"}}})
+
+			Expect(query).Should(Equal(bson.M{"$and": []bson.M{
+				{"count": bson.M{"$in": []interface{}{"3", int64(3), 3.0}}},
+				{"finished": bson.M{"$in": []interface{}{"true", true}}}}}))
+		})
+
+		It("Should match every value of a repeated filter_by", func() {
+			query := newFilterQuery(dataset.RecordFilter{FilterBy: map[string][]string{"tag": {"parrot", "blue"}}})
+
+			Expect(query).Should(Equal(bson.M{"$and": []bson.M{
+				{"tag": bson.M{"$in": []interface{}{"parrot"}}},
+				{"tag": bson.M{"$in": []interface{}{"blue"}}}}}))
+		})
+	})
+
+	Describe("Namespace errors", func() {
+		It("Should recognise a missing collection by the error code", func() {
+			Expect(isNamespaceNotFound(&mgo.QueryError{Code: 26, Message: "ns does not exist"})).Should(BeTrue())
+			Expect(isNamespaceNotFound(&mgo.QueryError{Code: 13, Message: "ns not found"})).Should(BeFalse())
+			Expect(isNamespaceNotFound(fmt.Errorf("ns not found"))).Should(BeFalse())
+		})
+	})
+
+	Describe("History", func() {
+		It("Should copy records into the history as versions of them", func() {
+			validTo := time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC)
+			records := []bson.M{{"_id": "parrot", "status": "pining"}}
+
+			versions := newHistoryRecords(records, validTo)
+
+			Expect(versions).Should(HaveLen(1))
+			Expect(versions[0]["_id"]).ShouldNot(Equal("parrot"))
+			Expect(versions[0]["_record_id"]).Should(Equal("parrot"))
+			Expect(versions[0]["_valid_to"]).Should(Equal(validTo))
+			Expect(versions[0]["status"]).Should(Equal("pining"))
+			Expect(records[0]["_id"]).Should(Equal("parrot"))
+		})
+
+		It("Should read versions as the records they were versions of", func() {
+			validTo := time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC)
+			version := bson.M{"_id": bson.NewObjectId(), "_record_id": "parrot", "_valid_to": validTo, "status": "pining"}
+
+			Expect(asRecord(version)).Should(Equal(map[string]interface{}{
+				"_id": "parrot", "_valid_to": validTo, "status": "pining"}))
+		})
+
+		It("Should keep the history where no data set can be", func() {
+			Expect(historyName("parrots")).Should(Equal("parrots.history"))
+		})
+
+		It("Should find the versions of a record which were valid at a time", func() {
+			asOf := time.Date(2015, 3, 31, 12, 0, 0, 0, time.UTC)
+			validFrom := []bson.M{
+				{"_valid_from": bson.M{"$lte": asOf}},
+				{"_valid_from": bson.M{"$exists": false}}}
+			filter := dataset.RecordFilter{ID: "parrot", AsOf: &asOf}
+
+			Expect(newAsOfQuery(filter, false)).Should(Equal(bson.M{
+				"_id": "parrot",
+				"$or": validFrom}))
+			Expect(newAsOfQuery(filter, true)).Should(Equal(bson.M{
+				"_record_id": "parrot",
+				"$or":        validFrom,
+				"_valid_to":  bson.M{"$gt": asOf}}))
+		})
+	})
+
+	// This checks the values we hand to mgo, not Mongo itself, which the
+	// benchmarks above exercise when MONGO_URL is set.
+	Describe("BSON encoding", func() {
+		It("Should decode validated records to the same values they were encoded from", func() {
+			var data []interface{}
+			Expect(utils.Unmarshal([]byte(`[{
+	"_timestamp": "2014-01-01T00:00:00Z",
+	"count": 9007199254740993,
+	"negative": -9223372036854775808,
+	"huge": 18446744073709551616,
+	"rate": 0.1,
+	"whole_rate": 2.0,
+	"pining": true,
+	"device": {"os": "android", "versions": [4, 4.4]}
+}]`), &data)).Should(BeNil())
+
+			records, err := dataset.DataSet{MetaData: config.DataSetMetaData{Name: "round_trip"}}.Validate(data)
+			Expect(err).Should(BeNil())
+
+			written, err := bson.Marshal(records[0])
+			Expect(err).Should(BeNil())
+			var read bson.M
+			Expect(bson.Unmarshal(written, &read)).Should(BeNil())
+
+			Expect(read["count"]).Should(Equal(int64(9007199254740993)))
+			Expect(read["negative"]).Should(Equal(int64(-9223372036854775808)))
+			Expect(read["huge"]).Should(Equal(18446744073709551616.0))
+			Expect(read["rate"]).Should(Equal(0.1))
+			Expect(read["whole_rate"]).Should(Equal(2.0))
+			Expect(read["pining"]).Should(Equal(true))
+			Expect(read["device"]).Should(Equal(bson.M{"os": "android", "versions": []interface{}{int64(4), 4.4}}))
+			Expect(read["_timestamp"].(time.Time).Equal(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))).Should(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/alphagov/performance-datastore/pkg/utils"
+)
+
+// NDJSONBatchSize is the number of records from a newline delimited JSON upload
+// which are validated and written together.
+var NDJSONBatchSize = 1000
+
+// NDJSONMaxLineSize is the longest line, in bytes, that a newline delimited
+// JSON upload can have.
+var NDJSONMaxLineSize = 1 << 20
+
+// handleStreamingCreate appends the records in a newline delimited JSON request
+// body to a DataSet, one record per line. The body is read and written in
+// batches of NDJSONBatchSize, so that large uploads don't have to fit in memory.
+//
+// Unlike JSON uploads, NDJSON uploads are not all-or-nothing: the batches before
+// a bad line or batch are kept. The response reports how many records were
+// processed and written, so that the client can resume from there.
+func handleStreamingCreate(w http.ResponseWriter, r *http.Request) {
+	dataSet, ok := authorizedDataSet(w, r)
+	if !ok || !allowWrite(w, r, dataSet, 1, 0, nil) {
+		return
+	}
+
+	if r.Header.Get("Idempotency-Key") != "" {
+		renderError(w, http.StatusBadRequest, "Idempotency-Key is not supported for "+ndjsonContentType+" uploads")
+		return
+	}
+
+	meta := &ResponseMeta{}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, NDJSONMaxLineSize)
+	batch := make([]interface{}, 0, NDJSONBatchSize)
+	line := 0
+
+	writeBatch := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+
+		if !allowWrite(w, r, dataSet, 0, len(batch), meta) {
+			return false
+		}
+
+		result, err := dataSet.Append(batch)
+		if err != nil {
+			if errors, ok := err.(dataset.ValidationErrors); ok {
+				err = errors.Offset(meta.Processed)
+			}
+			renderStreamingError(w, dataSet, meta, err)
+			return false
+		}
+
+		meta.Processed += len(batch)
+		setRecordCount(r, meta.Processed)
+		meta.Inserted += result.Inserted
+		meta.Updated += result.Updated
+		meta.Journaled += result.Journaled
+		batch = batch[:0]
+		return true
+	}
+
+	for scanner.Scan() {
+		trimmed := bytes.TrimSpace(scanner.Bytes())
+		if len(trimmed) == 0 {
+			continue
+		}
+		line++
+
+		var record interface{}
+		if jsonErr := utils.Unmarshal(trimmed, &record); jsonErr != nil {
+			if writeBatch() {
+				renderStreamingStatus(w, http.StatusBadRequest, meta,
+					fmt.Sprintf("Error parsing JSON on line %d: %s", line, jsonErr.Error()))
+			}
+			return
+		}
+
+		// Keep the records before a line which isn't a record, like any other bad line
+		if _, ok := record.(map[string]interface{}); !ok {
+			if writeBatch() {
+				renderStreamingError(w, dataSet, meta, dataset.ValidationErrors{&dataset.RecordError{
+					Index:  meta.Processed,
+					Path:   fmt.Sprintf("/%d", meta.Processed),
+					Code:   dataset.NotAnObjectCode,
+					Detail: fmt.Sprintf("Line %d is not a JSON object", line)}})
+			}
+			return
+		}
+
+		batch = append(batch, record)
+		if len(batch) == NDJSONBatchSize && !writeBatch() {
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if gzerr, ok := err.(*gzipBombError); ok {
+			renderStreamingStatus(w, http.StatusRequestEntityTooLarge, meta, gzerr.Error())
+		} else if err == bufio.ErrTooLong {
+			// Keep the records before the long line, like any other bad line
+			if writeBatch() {
+				renderStreamingError(w, dataSet, meta, dataset.ValidationErrors{&dataset.RecordError{
+					Index:  meta.Processed,
+					Path:   fmt.Sprintf("/%d", meta.Processed),
+					Code:   dataset.RecordTooLargeCode,
+					Detail: fmt.Sprintf("Line %d is longer than the limit of %d bytes", line+1, NDJSONMaxLineSize)}})
+			}
+		} else {
+			renderStreamingStatus(w, http.StatusBadRequest, meta, err.Error())
+		}
+		return
+	}
+
+	if line == 0 {
+		renderError(w, http.StatusBadRequest, "Expected NDJSON request body but received no records")
+		return
+	}
+
+	if !writeBatch() {
+		return
+	}
+
+	renderer.JSON(w, http.StatusOK, APIResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Processed %d records for %s", meta.Processed, dataSet.Name()),
+		Meta:    meta})
+}
+
+// renderStreamingError is renderWriteError for NDJSON uploads, which also
+// reports what had been written before the error.
+func renderStreamingError(w http.ResponseWriter, dataSet dataset.DataSet, meta *ResponseMeta, err error) {
+	if errors, ok := err.(dataset.ValidationErrors); ok {
+		response := newErrorResponse(newValidationErrorInfos(errors))
+		response.Meta = meta
+		renderer.JSON(w, http.StatusBadRequest, response)
+		return
+	}
+
+	StatsdClient.Incr("write.error."+dataSet.Name(), 1)
+	renderStreamingStatus(w, http.StatusInternalServerError, meta, err.Error())
+}
+
+func renderStreamingStatus(w http.ResponseWriter, status int, meta *ResponseMeta, message string) {
+	response := newErrorResponse(newErrorInfos(message))
+	response.Meta = meta
+	renderer.JSON(w, status, response)
+}
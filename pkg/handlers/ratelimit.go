@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphagov/performance-datastore/pkg/config"
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+)
+
+// RateLimiter keeps a token bucket for each bearer token and DataSet that
+// writes, so that one busy collector can't starve the others of storage.
+type RateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled, after which it is no
+	// different from a new one and can be forgotten.
+	full time.Time
+}
+
+// rateLimiterSweepInterval is how often a RateLimiter forgets its full buckets.
+const rateLimiterSweepInterval = time.Minute
+
+// NewRateLimiter returns a RateLimiter with all of its buckets full.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// Tokens are N tokens to take from a bucket which fills at Limit.
+type Tokens struct {
+	N     int
+	Limit config.RateLimit
+}
+
+// Take takes tokens from each of the buckets named by the keys of tokens. A
+// bucket holds at most its limit's Burst tokens, but a take of more than that
+// is allowed once the bucket is full, leaving it in debt. If any of the
+// buckets doesn't have enough tokens, none are taken, and the time until they
+// all will and the key of the bucket with the longest wait are returned.
+func (l *RateLimiter) Take(tokens map[string]Tokens) (retryAfter time.Duration, limitedBy string, ok bool) {
+	return l.take(tokens, true)
+}
+
+// Check is Take without taking anything, for rejecting a request before
+// doing any work when it can't be allowed anyway.
+func (l *RateLimiter) Check(tokens map[string]Tokens) (retryAfter time.Duration, limitedBy string, ok bool) {
+	return l.take(tokens, false)
+}
+
+func (l *RateLimiter) take(tokens map[string]Tokens, commit bool) (retryAfter time.Duration, limitedBy string, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	buckets := make(map[string]*tokenBucket)
+
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	for key, t := range tokens {
+		if t.N <= 0 || t.Limit.PerSecond <= 0 {
+			continue
+		}
+		burst := math.Max(float64(t.Limit.Burst), 1)
+
+		bucket, found := l.buckets[key]
+		if !found {
+			bucket = &tokenBucket{tokens: burst, last: now}
+			l.buckets[key] = bucket
+		}
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*t.Limit.PerSecond)
+		bucket.last = now
+
+		if needed := math.Min(float64(t.N), burst); bucket.tokens < needed {
+			wait := time.Duration((needed - bucket.tokens) / t.Limit.PerSecond * float64(time.Second))
+			if wait > retryAfter {
+				retryAfter, limitedBy = wait, key
+			}
+		}
+		buckets[key] = bucket
+	}
+
+	if retryAfter > 0 {
+		return retryAfter, limitedBy, false
+	}
+	if !commit {
+		return 0, "", true
+	}
+
+	for key, bucket := range buckets {
+		t := tokens[key]
+		bucket.tokens -= float64(t.N)
+		refill := (math.Max(float64(t.Limit.Burst), 1) - bucket.tokens) / t.Limit.PerSecond
+		bucket.full = now.Add(time.Duration(refill * float64(time.Second)))
+	}
+	return 0, "", true
+}
+
+// sweep forgets the buckets which have refilled, so that bearer tokens and
+// DataSets which no longer write don't keep them forever.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if !bucket.full.After(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// ParseRateLimit reads a rate limit written as "per_second" or
+// "per_second:burst". The burst defaults to one second's worth. An empty
+// string means no limit.
+func ParseRateLimit(s string) (limit config.RateLimit, err error) {
+	if s == "" {
+		return
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	if limit.PerSecond, err = strconv.ParseFloat(parts[0], 64); err != nil || limit.PerSecond < 0 {
+		return limit, fmt.Errorf("invalid rate limit %q", s)
+	}
+
+	limit.Burst = int(math.Ceil(limit.PerSecond))
+	if len(parts) == 2 {
+		if limit.Burst, err = strconv.Atoi(parts[1]); err != nil || limit.Burst < 1 {
+			return limit, fmt.Errorf("invalid rate limit %q", s)
+		}
+	}
+
+	return limit, nil
+}
+
+// writeTokens are the tokens a write of requests requests and records records
+// takes from the rate limits for the request's bearer token and for the
+// DataSet. DataSets without RateLimits in their meta data have
+// DefaultDataSetRateLimits.
+func writeTokens(r *http.Request, dataSet dataset.DataSet, requests int, records int) map[string]Tokens {
+	dataSetLimits := dataSet.MetaData.RateLimits
+	if dataSetLimits == nil {
+		dataSetLimits = &DefaultDataSetRateLimits
+	}
+
+	token, _ := extractBearerToken(dataSet, r.Header.Get("Authorization"))
+
+	return map[string]Tokens{
+		"requests:token:" + token:            {requests, RateLimits.Requests},
+		"records:token:" + token:             {records, RateLimits.Records},
+		"requests:dataset:" + dataSet.Name(): {requests, dataSetLimits.Requests},
+		"records:dataset:" + dataSet.Name():  {records, dataSetLimits.Records}}
+}
+
+// rateLimited is middleware which responds with a 429, before the body is
+// read, to writes made when there are no requests left in the rate limits for
+// the bearer token or the DataSet. It doesn't take anything, since the body
+// may yet turn out to have too many records, be invalid or be a replay of an
+// Idempotency-Key; the handler does that with allowWrite.
+func rateLimited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if WriteRateLimiter == nil {
+			h(w, r)
+			return
+		}
+
+		dataSet, ok := authorizedDataSet(w, r)
+		if !ok {
+			return
+		}
+
+		if retryAfter, limitedBy, ok := WriteRateLimiter.Check(writeTokens(r, dataSet, 1, 0)); !ok {
+			renderRateLimited(w, dataSet, limitedBy, retryAfter, nil)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// allowWrite takes the tokens for a write of requests requests and records
+// records from both the request and record rate limits at once, so that a
+// write refused for having too many records doesn't use up a request. It
+// writes a 429 response and returns false if a rate limit has been reached.
+func allowWrite(w http.ResponseWriter, r *http.Request, dataSet dataset.DataSet, requests int, records int, meta *ResponseMeta) bool {
+	if WriteRateLimiter == nil {
+		return true
+	}
+
+	retryAfter, limitedBy, ok := WriteRateLimiter.Take(writeTokens(r, dataSet, requests, records))
+	if !ok {
+		renderRateLimited(w, dataSet, limitedBy, retryAfter, meta)
+	}
+	return ok
+}
+
+// renderRateLimited responds with a 429 saying which of requests or records,
+// going by the limitedBy bucket key, there were too many of.
+func renderRateLimited(w http.ResponseWriter, dataSet dataset.DataSet, limitedBy string, retryAfter time.Duration, meta *ResponseMeta) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	what := strings.SplitN(limitedBy, ":", 2)[0]
+
+	StatsdClient.Incr("write.rate_limited."+dataSet.Name(), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	response := newErrorResponse(newErrorInfos(
+		fmt.Sprintf("Too many %s written to %s, retry after %d seconds", what, dataSet.Name(), seconds)))
+	response.Meta = meta
+	renderer.JSON(w, http.StatusTooManyRequests, response)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+)
+
+// RetentionResult describes the records in a DataSet which are older than its
+// retention period.
+type RetentionResult struct {
+	Name      string    `json:"name"`
+	Retention string    `json:"retention"`
+	Cutoff    time.Time `json:"cutoff"`
+	Expired   int       `json:"expired"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ExpireRecords removes the records which are older than the retention period
+// of each DataSet that has one, or only counts them if dryRun is set.
+// A DataSet which can't be expired doesn't stop the others; its error is in
+// its RetentionResult. The logger is only used if dryRun isn't set.
+func ExpireRecords(now time.Time, dryRun bool, logger *logrus.Logger) ([]RetentionResult, error) {
+	datasets, err := ConfigAPIClient.ListDataSets()
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := []RetentionResult{}
+
+	for _, metaData := range datasets {
+		if metaData.Retention == "" {
+			continue
+		}
+
+		dataSet := dataset.DataSet{DataSetStorage, metaData}
+		result := RetentionResult{Name: dataSet.Name(), Retention: metaData.Retention}
+
+		cutoff, err := dataSet.RetentionCutoff(now)
+		if err == nil {
+			result.Cutoff = *cutoff
+			result.Expired, err = dataSet.Expire(now, dryRun)
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		// dry runs are only reported, not logged or counted
+		if !dryRun {
+			logExpiry(logger, result)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func logExpiry(logger *logrus.Logger, result RetentionResult) {
+	entry := logger.WithFields(logrus.Fields{
+		"dataset":   result.Name,
+		"retention": result.Retention,
+		"expired":   result.Expired})
+
+	if result.Error != "" {
+		entry.Errorf("Unable to expire records: %v", result.Error)
+		StatsdClient.Incr("retention.error."+result.Name, 1)
+	} else if result.Expired > 0 {
+		entry.Infof("Expired %d records older than %v", result.Expired, result.Cutoff)
+		StatsdClient.Incr("retention.expired."+result.Name, int64(result.Expired))
+	}
+}
+
+// RunRetentionReaper expires records every interval until stop is closed.
+func RunRetentionReaper(interval time.Duration, logger *logrus.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reapExpiredRecords(logger)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reapExpiredRecords is one run of the retention reaper. A panic is logged
+// rather than stopping the reaper, so that the next run can try again.
+func reapExpiredRecords(logger *logrus.Logger) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("PANIC: expiring records: %s\n%s", err, stack(3))
+			StatsdClient.Incr("retention.panic", 1)
+		}
+	}()
+
+	if _, err := ExpireRecords(time.Now(), false, logger); err != nil {
+		logger.Errorf("Unable to list the data sets to expire: %v", err)
+	}
+}
+
+// RetentionStatusMaxAge is how long RetentionHandler reuses its counts for,
+// since counting the expired records in every DataSet is expensive.
+var RetentionStatusMaxAge = 5 * time.Minute
+
+var retentionStatus struct {
+	sync.Mutex
+	results []RetentionResult
+	at      time.Time
+}
+
+// RetentionHandler reports how many records would be removed from each DataSet
+// with a retention period, without removing anything. The counts are at most
+// RetentionStatusMaxAge old.
+//
+// GET /_status/retention
+func RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	// concurrent requests wait for one count rather than each running their own
+	retentionStatus.Lock()
+	results := retentionStatus.results
+	if results == nil || time.Since(retentionStatus.at) >= RetentionStatusMaxAge {
+		var err error
+		if results, err = ExpireRecords(time.Now(), true, nil); err != nil {
+			retentionStatus.Unlock()
+			renderError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		retentionStatus.results, retentionStatus.at = results, time.Now()
+	}
+	retentionStatus.Unlock()
+
+	setStatusHeaders(w)
+
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"data-sets": results})
+}
@@ -0,0 +1,197 @@
+package upload
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+	"github.com/alphagov/performance-datastore/pkg/utils"
+)
+
+// ParseCSV converts CSV into records, using the header row for the keys. Values
+// are converted to the type given for their column in schema, if there is one,
+// otherwise numbers and booleans are recognised. Empty cells become nulls.
+func ParseCSV(r io.Reader, schema json.RawMessage) ([]interface{}, error) {
+	reader := csv.NewReader(r)
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		if csvErr, ok := err.(*csv.ParseError); ok {
+			return nil, &ParseError{csvErr.Line, csvErr.Column, csvErr.Err.Error()}
+		}
+		return nil, err
+	}
+
+	cells := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		cells[i] = make([]interface{}, len(row))
+		for j, cell := range row {
+			cells[i][j] = cell
+		}
+	}
+
+	return toRecords(cells, 0, dataset.SchemaTypes(schema))
+}
+
+// toRecords converts rows of cells into records. The first row is the header,
+// and it is row headerRow+1 of the upload. Cells are either strings, which are
+// converted as described for ParseCSV, or values which have already been typed.
+// Rows without any values are skipped.
+func toRecords(rows [][]interface{}, headerRow int, types map[string]string) ([]interface{}, error) {
+	if len(rows) == 0 {
+		return nil, &ParseError{headerRow + 1, 1, "expected a header row"}
+	}
+
+	header := make([]string, len(rows[0]))
+	seen := make(map[string]bool)
+	for i, cell := range rows[0] {
+		key := ""
+		if cell != nil {
+			key = strings.TrimSpace(fmt.Sprint(cell))
+		}
+		if key == "" {
+			return nil, &ParseError{headerRow + 1, i + 1, "header is empty"}
+		}
+		if seen[key] {
+			return nil, &ParseError{headerRow + 1, i + 1, fmt.Sprintf("header %s is repeated", key)}
+		}
+		seen[key] = true
+		header[i] = key
+	}
+
+	records := make([]interface{}, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		if isEmptyRow(row) {
+			continue
+		}
+
+		record := make(map[string]interface{}, len(header))
+		for j, key := range header {
+			var cell interface{}
+			if j < len(row) {
+				cell = row[j]
+			}
+
+			value, err := convertCell(cell, types[key])
+			if err != nil {
+				return nil, &ParseError{headerRow + i + 2, j + 1, err.Error()}
+			}
+			record[key] = value
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func isEmptyRow(row []interface{}) bool {
+	for _, cell := range row {
+		if value, _ := convertCell(cell, ""); value != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func convertCell(cell interface{}, schemaType string) (interface{}, error) {
+	switch value := cell.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return convertString(value, schemaType)
+	case float64:
+		switch schemaType {
+		case "string":
+			return strconv.FormatFloat(value, 'f', -1, 64), nil
+		case "integer":
+			if value != math.Trunc(value) {
+				return nil, fmt.Errorf("%v is not an integer", value)
+			}
+		case "boolean":
+			return nil, fmt.Errorf("%v is not a boolean", value)
+		}
+	case int64:
+		switch schemaType {
+		case "string":
+			return strconv.FormatInt(value, 10), nil
+		case "boolean":
+			return nil, fmt.Errorf("%v is not a boolean", value)
+		}
+	case bool:
+		switch schemaType {
+		case "string":
+			return strconv.FormatBool(value), nil
+		case "number", "integer":
+			return nil, fmt.Errorf("%v is not a number", value)
+		}
+	}
+	return cell, nil
+}
+
+func convertString(cell string, schemaType string) (interface{}, error) {
+	if strings.TrimSpace(cell) == "" {
+		return nil, nil
+	}
+
+	switch schemaType {
+	case "string":
+		return cell, nil
+	case "number":
+		return parseNumber(cell)
+	case "integer":
+		number, err := parseNumber(cell)
+		if err != nil {
+			return nil, err
+		}
+		if f, isFloat := number.(float64); isFloat && f != math.Trunc(f) {
+			return nil, fmt.Errorf("%s is not an integer", cell)
+		}
+		return number, nil
+	case "boolean":
+		value, err := strconv.ParseBool(strings.TrimSpace(cell))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a boolean", cell)
+		}
+		return value, nil
+	}
+
+	return inferValue(cell), nil
+}
+
+// parseNumber parses cell like a number in a JSON request body, as an int64 if
+// it is an integer which fits in one, otherwise as a float64.
+func parseNumber(cell string) (interface{}, error) {
+	number, err := utils.ParseNumber(strings.TrimSpace(cell))
+	if f, isFloat := number.(float64); err != nil || isFloat && (math.IsInf(f, 0) || math.IsNaN(f)) {
+		return nil, fmt.Errorf("%s is not a number", cell)
+	}
+	return number, nil
+}
+
+// inferValue recognises numbers and booleans. Numbers with leading zeros are
+// left as strings, since they are usually codes rather than quantities.
+func inferValue(cell string) interface{} {
+	trimmed := strings.TrimSpace(cell)
+
+	switch trimmed {
+	case "true", "TRUE", "True":
+		return true
+	case "false", "FALSE", "False":
+		return false
+	}
+
+	digits := strings.TrimLeft(trimmed, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+		return cell
+	}
+
+	if number, err := parseNumber(trimmed); err == nil {
+		return number
+	}
+	return cell
+}
@@ -0,0 +1,80 @@
+package upload
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CSV", func() {
+	It("Should use the header row for keys", func() {
+		records, err := ParseCSV(strings.NewReader("name,count\nfoo,1\nbar,2.5\n"), nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"name": "foo", "count": int64(1)},
+			map[string]interface{}{"name": "bar", "count": 2.5}}))
+	})
+
+	It("Should infer numbers, booleans and nulls", func() {
+		records, err := ParseCSV(strings.NewReader("a,b,c,d,e,f\n-3,true,,007,1e3,9007199254740993\n"), nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"a": int64(-3), "b": true, "c": nil, "d": "007", "e": 1000.0, "f": int64(9007199254740993)}}))
+	})
+
+	It("Should use the types from the schema", func() {
+		schema := json.RawMessage(`{"properties": {"code": {"type": "string"}, "count": {"type": "integer"}}}`)
+
+		records, err := ParseCSV(strings.NewReader("code,count\n123,4\n"), schema)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"code": "123", "count": int64(4)}}))
+	})
+
+	It("Should use nullable types and the types from allOf schemas", func() {
+		schema := json.RawMessage(`{"properties": {"code": {"type": ["string", "null"]}},` +
+			`"allOf": [{"properties": {"ref": {"type": "string"}}}]}`)
+
+		records, err := ParseCSV(strings.NewReader("code,ref\n123,456\n,7\n"), schema)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"code": "123", "ref": "456"},
+			map[string]interface{}{"code": nil, "ref": "7"}}))
+	})
+
+	It("Should report the row and column of values which don't match the schema", func() {
+		schema := json.RawMessage(`{"properties": {"count": {"type": "integer"}}}`)
+
+		_, err := ParseCSV(strings.NewReader("name,count\nfoo,4\nbar,4.5\n"), schema)
+
+		Expect(err).Should(Equal(&ParseError{3, 2, "4.5 is not an integer"}))
+		Expect(err.Error()).Should(Equal("row 3, column 2: 4.5 is not an integer"))
+	})
+
+	It("Should report the row of rows with the wrong number of cells", func() {
+		_, err := ParseCSV(strings.NewReader("name,count\nfoo,4,extra\n"), nil)
+
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.(*ParseError).Row).Should(Equal(2))
+	})
+
+	It("Should need a header row", func() {
+		_, err := ParseCSV(strings.NewReader(""), nil)
+
+		Expect(err).Should(Equal(&ParseError{1, 1, "expected a header row"}))
+	})
+
+	It("Should not allow empty or repeated headers", func() {
+		_, err := ParseCSV(strings.NewReader("a,,c\n1,2,3\n"), nil)
+		Expect(err).Should(Equal(&ParseError{1, 2, "header is empty"}))
+
+		_, err = ParseCSV(strings.NewReader("a,b,a\n1,2,3\n"), nil)
+		Expect(err).Should(Equal(&ParseError{1, 3, "header a is repeated"}))
+	})
+})
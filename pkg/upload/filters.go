@@ -0,0 +1,171 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Filter reshapes the records from an upload before they are validated.
+type Filter func(records []map[string]interface{}) ([]map[string]interface{}, error)
+
+// FilterError describes a record which a Filter couldn't reshape. Record is
+// the index of the record, counted from 0.
+type FilterError struct {
+	Record int
+	Detail string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.Record, e.Detail)
+}
+
+// FilterFactory returns a Filter configured with the arguments from its name.
+type FilterFactory func(args []string) (Filter, error)
+
+var filters = map[string]FilterFactory{
+	"rename_column": newRenameColumnFilter,
+	"drop_rows":     newDropRowsFilter,
+	"pivot_longer":  newPivotLongerFilter,
+
+	// backdrop chose the sheet to read with a filter, which we do when parsing
+	"backdrop.core.upload.filters.first_sheet_filter": newNoopFilter,
+}
+
+// RegisterFilter makes a Filter available to DataSets by name.
+func RegisterFilter(name string, factory FilterFactory) {
+	filters[name] = factory
+}
+
+// NewFilter returns the Filter for a name from DataSetMetaData.UploadFilters.
+// Arguments follow the name, separated by colons, for example "drop_rows:2".
+func NewFilter(spec string) (Filter, error) {
+	parts := strings.Split(spec, ":")
+
+	factory, ok := filters[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown upload filter '%s'", parts[0])
+	}
+
+	filter, err := factory(parts[1:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upload filter '%s': %v", spec, err)
+	}
+	return filter, nil
+}
+
+// NewFilters returns the Filters for each of specs, in the same order. Names
+// which aren't registered, such as backdrop's contrib filters, are skipped
+// and returned in unknown so that they can be logged.
+func NewFilters(specs []string) (result []Filter, unknown []string, err error) {
+	for _, spec := range specs {
+		name := strings.Split(spec, ":")[0]
+		if _, ok := filters[name]; !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		filter, err := NewFilter(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, filter)
+	}
+	return result, unknown, nil
+}
+
+func newNoopFilter(args []string) (Filter, error) {
+	return func(records []map[string]interface{}) ([]map[string]interface{}, error) {
+		return records, nil
+	}, nil
+}
+
+// rename_column:from:to
+func newRenameColumnFilter(args []string) (Filter, error) {
+	if len(args) != 2 || args[0] == "" || args[1] == "" {
+		return nil, fmt.Errorf("expected the names of the column and its new name")
+	}
+	from, to := args[0], args[1]
+
+	return func(records []map[string]interface{}) ([]map[string]interface{}, error) {
+		for i, record := range records {
+			value, ok := record[from]
+			if !ok {
+				continue
+			}
+			if _, exists := record[to]; exists {
+				return nil, &FilterError{i, fmt.Sprintf("there is already a %s column, so %s can't be renamed", to, from)}
+			}
+			delete(record, from)
+			record[to] = value
+		}
+		return records, nil
+	}, nil
+}
+
+// drop_rows:n
+func newDropRowsFilter(args []string) (Filter, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected the number of rows to drop")
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s is not a number of rows", args[0])
+	}
+
+	return func(records []map[string]interface{}) ([]map[string]interface{}, error) {
+		if n > len(records) {
+			return records[:0], nil
+		}
+		return records[n:], nil
+	}, nil
+}
+
+// pivot_longer:key:value:id...
+//
+// Turns each column other than the id columns into a record of its own, with
+// the column name in key and its value in value. The id columns are copied to
+// each of the new records. Empty cells don't become records.
+func newPivotLongerFilter(args []string) (Filter, error) {
+	if len(args) < 2 || args[0] == "" || args[1] == "" {
+		return nil, fmt.Errorf("expected the names of the key and value columns")
+	}
+	key, value := args[0], args[1]
+
+	ids := make(map[string]bool)
+	for _, id := range args[2:] {
+		ids[id] = true
+	}
+
+	return func(records []map[string]interface{}) ([]map[string]interface{}, error) {
+		var result []map[string]interface{}
+
+		for _, record := range records {
+			var columns []string
+			for column := range record {
+				if !ids[column] {
+					columns = append(columns, column)
+				}
+			}
+			sort.Strings(columns)
+
+			for _, column := range columns {
+				if record[column] == nil {
+					continue
+				}
+
+				pivoted := map[string]interface{}{key: column, value: record[column]}
+				for id := range ids {
+					if v, ok := record[id]; ok {
+						pivoted[id] = v
+					}
+				}
+				result = append(result, pivoted)
+			}
+		}
+
+		return result, nil
+	}, nil
+}
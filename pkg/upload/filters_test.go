@@ -0,0 +1,122 @@
+package upload
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func applyFilter(spec string, records ...map[string]interface{}) ([]map[string]interface{}, error) {
+	filter, err := NewFilter(spec)
+	Expect(err).Should(BeNil())
+	return filter(records)
+}
+
+var _ = Describe("Filters", func() {
+	It("Should fail for an unknown filter", func() {
+		_, err := NewFilter("unknown:1")
+
+		Expect(err).Should(MatchError("Unknown upload filter 'unknown'"))
+	})
+
+	It("Should skip unknown filters in a list", func() {
+		result, unknown, err := NewFilters([]string{"drop_rows:1", "backdrop.contrib.evl_upload_filters.channel_volumetrics"})
+
+		Expect(err).Should(BeNil())
+		Expect(result).Should(HaveLen(1))
+		Expect(unknown).Should(Equal([]string{"backdrop.contrib.evl_upload_filters.channel_volumetrics"}))
+	})
+
+	It("Should fail for known filters with invalid arguments", func() {
+		_, _, err := NewFilters([]string{"drop_rows:many"})
+
+		Expect(err).Should(MatchError("Invalid upload filter 'drop_rows:many': many is not a number of rows"))
+	})
+
+	It("Should allow filters to be registered", func() {
+		RegisterFilter("test_filter", newNoopFilter)
+		defer delete(filters, "test_filter")
+
+		filter, err := NewFilter("test_filter")
+
+		Expect(err).Should(BeNil())
+		Expect(filter).ShouldNot(BeNil())
+	})
+
+	It("Should accept backdrop's first sheet filter", func() {
+		records, err := applyFilter("backdrop.core.upload.filters.first_sheet_filter",
+			map[string]interface{}{"a": 1.0})
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]map[string]interface{}{{"a": 1.0}}))
+	})
+
+	Describe("rename_column", func() {
+		It("Should rename the column", func() {
+			records, err := applyFilter("rename_column:Period:_timestamp",
+				map[string]interface{}{"Period": "2014-01-01T00:00:00Z", "count": 1.0},
+				map[string]interface{}{"count": 2.0})
+
+			Expect(err).Should(BeNil())
+			Expect(records).Should(Equal([]map[string]interface{}{
+				{"_timestamp": "2014-01-01T00:00:00Z", "count": 1.0},
+				{"count": 2.0}}))
+		})
+
+		It("Should not overwrite another column", func() {
+			_, err := applyFilter("rename_column:a:b",
+				map[string]interface{}{"a": 1.0, "b": 2.0})
+
+			Expect(err).Should(Equal(&FilterError{0, "there is already a b column, so a can't be renamed"}))
+		})
+
+		It("Should need two column names", func() {
+			_, err := NewFilter("rename_column:a")
+
+			Expect(err).Should(MatchError("Invalid upload filter 'rename_column:a': expected the names of the column and its new name"))
+		})
+	})
+
+	Describe("drop_rows", func() {
+		It("Should drop the first rows", func() {
+			records, err := applyFilter("drop_rows:1",
+				map[string]interface{}{"count": "units"},
+				map[string]interface{}{"count": 2.0})
+
+			Expect(err).Should(BeNil())
+			Expect(records).Should(Equal([]map[string]interface{}{{"count": 2.0}}))
+		})
+
+		It("Should drop every row if there are fewer than n", func() {
+			records, err := applyFilter("drop_rows:3", map[string]interface{}{"count": 2.0})
+
+			Expect(err).Should(BeNil())
+			Expect(records).Should(BeEmpty())
+		})
+
+		It("Should need a number of rows", func() {
+			_, err := NewFilter("drop_rows:-1")
+
+			Expect(err).Should(MatchError("Invalid upload filter 'drop_rows:-1': -1 is not a number of rows"))
+		})
+	})
+
+	Describe("pivot_longer", func() {
+		It("Should make a record for each column which isn't an id", func() {
+			records, err := applyFilter("pivot_longer:month:count:service:region",
+				map[string]interface{}{"service": "tax", "region": "north", "jan": 1.0, "feb": 2.0, "mar": nil},
+				map[string]interface{}{"service": "vat", "jan": 3.0})
+
+			Expect(err).Should(BeNil())
+			Expect(records).Should(Equal([]map[string]interface{}{
+				{"service": "tax", "region": "north", "month": "feb", "count": 2.0},
+				{"service": "tax", "region": "north", "month": "jan", "count": 1.0},
+				{"service": "vat", "month": "jan", "count": 3.0}}))
+		})
+
+		It("Should need the key and value columns", func() {
+			_, err := NewFilter("pivot_longer:month")
+
+			Expect(err).Should(MatchError("Invalid upload filter 'pivot_longer:month': expected the names of the key and value columns"))
+		})
+	})
+})
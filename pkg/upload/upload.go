@@ -0,0 +1,17 @@
+// Package upload converts spreadsheet uploads into records which can be
+// written to a DataSet.
+package upload
+
+import "fmt"
+
+// ParseError describes a problem with a cell in an upload. Rows and columns
+// are counted from 1, including the header row, as a spreadsheet would show them.
+type ParseError struct {
+	Row    int
+	Column int
+	Detail string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("row %d, column %d: %s", e.Row, e.Column, e.Detail)
+}
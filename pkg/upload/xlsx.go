@@ -0,0 +1,427 @@
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphagov/performance-datastore/pkg/dataset"
+)
+
+const (
+	// defaultMaxXLSXPartSize limits how much of each part of a workbook we
+	// will decompress, if XLSXOptions doesn't say.
+	defaultMaxXLSXPartSize = 256 << 20
+	// defaultMaxXLSXCells limits how many cells of a worksheet we will hold,
+	// if XLSXOptions doesn't say.
+	defaultMaxXLSXCells = 4 << 20
+	// The largest worksheet that Excel allows.
+	maxXLSXRows    = 1048576
+	maxXLSXColumns = 16384
+)
+
+// XLSXOptions chooses the data to read from a workbook.
+type XLSXOptions struct {
+	// Sheet is the name of the worksheet to read. The first sheet is read if it is empty.
+	Sheet string
+	// HeaderRow is the row holding the keys, counted from 1. Rows above it are ignored.
+	HeaderRow int
+	// MaxPartSize limits how many bytes of each part of the workbook are
+	// decompressed, so that a small upload can't use up all of our memory.
+	MaxPartSize int64
+	// MaxCells limits how many cells of the worksheet are held, counting the
+	// empty cells before the last one in each row, so that a few cells far
+	// apart can't use up all of our memory either.
+	MaxCells int
+}
+
+// ParseXLSX converts a worksheet of an Excel workbook into records, in the same
+// way as ParseCSV. Cells formatted as dates become ISO8601 timestamps, as do
+// numbers in a _timestamp column.
+func ParseXLSX(body []byte, options XLSXOptions, schema json.RawMessage) ([]interface{}, error) {
+	if options.HeaderRow == 0 {
+		options.HeaderRow = 1
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("not an xlsx file: %v", err)
+	}
+
+	w := &workbook{files: make(map[string]*zip.File), maxPartSize: options.MaxPartSize, maxCells: options.MaxCells}
+	if w.maxPartSize <= 0 {
+		w.maxPartSize = defaultMaxXLSXPartSize
+	}
+	if w.maxCells <= 0 {
+		w.maxCells = defaultMaxXLSXCells
+	}
+	for _, f := range archive.File {
+		w.files[f.Name] = f
+	}
+
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+
+	sheetPath, err := w.sheetPath(options.Sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := w.readSheet(sheetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) < options.HeaderRow {
+		return nil, &ParseError{options.HeaderRow, 1, "expected a header row"}
+	}
+	rows = rows[options.HeaderRow-1:]
+
+	for i, cell := range rows[0] {
+		if cell == "_timestamp" {
+			timestampColumn(rows[1:], i, w.date1904)
+		}
+	}
+
+	return toRecords(rows, options.HeaderRow-1, dataset.SchemaTypes(schema))
+}
+
+type workbook struct {
+	files         map[string]*zip.File
+	sheets        []xlsxSheet
+	relationships map[string]string
+	sharedStrings []string
+	dateStyles    map[int]bool
+	date1904      bool
+	maxPartSize   int64
+	maxCells      int
+}
+
+type xlsxSheet struct {
+	Name string `xml:"name,attr"`
+	ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+}
+
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Style  int    `xml:"s,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string `xml:",innerxml"`
+	} `xml:"is"`
+}
+
+func (w *workbook) decode(name string, v interface{}) error {
+	f, ok := w.files[name]
+	if !ok {
+		return fmt.Errorf("not an xlsx file: %s is missing", name)
+	}
+
+	reader, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if f.UncompressedSize64 > uint64(w.maxPartSize) {
+		return fmt.Errorf("%s is larger than the limit of %d bytes", name, w.maxPartSize)
+	}
+
+	if err := xml.NewDecoder(io.LimitReader(reader, w.maxPartSize)).Decode(v); err != nil {
+		return fmt.Errorf("not an xlsx file: unable to read %s: %v", name, err)
+	}
+	return nil
+}
+
+func (w *workbook) load() error {
+	var book struct {
+		Properties struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []xlsxSheet `xml:"sheets>sheet"`
+	}
+	if err := w.decode("xl/workbook.xml", &book); err != nil {
+		return err
+	}
+	w.sheets = book.Sheets
+	w.date1904 = book.Properties.Date1904 == "1" || book.Properties.Date1904 == "true"
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := w.decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return err
+	}
+	w.relationships = make(map[string]string)
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		w.relationships[rel.ID] = target
+	}
+
+	if _, ok := w.files["xl/sharedStrings.xml"]; ok {
+		var sst struct {
+			Items []struct {
+				Text string `xml:",innerxml"`
+			} `xml:"si"`
+		}
+		if err := w.decode("xl/sharedStrings.xml", &sst); err != nil {
+			return err
+		}
+		for _, item := range sst.Items {
+			w.sharedStrings = append(w.sharedStrings, richText(item.Text))
+		}
+	}
+
+	w.dateStyles = make(map[int]bool)
+	if _, ok := w.files["xl/styles.xml"]; ok {
+		var styles struct {
+			NumFmts []struct {
+				ID   int    `xml:"numFmtId,attr"`
+				Code string `xml:"formatCode,attr"`
+			} `xml:"numFmts>numFmt"`
+			CellXfs []struct {
+				NumFmtID int `xml:"numFmtId,attr"`
+			} `xml:"cellXfs>xf"`
+		}
+		if err := w.decode("xl/styles.xml", &styles); err != nil {
+			return err
+		}
+
+		dateFormats := make(map[int]bool)
+		for _, format := range styles.NumFmts {
+			dateFormats[format.ID] = isDateFormatCode(format.Code)
+		}
+		for i, xf := range styles.CellXfs {
+			isDate, custom := dateFormats[xf.NumFmtID]
+			w.dateStyles[i] = isDate || (!custom && isBuiltInDateFormat(xf.NumFmtID))
+		}
+	}
+
+	return nil
+}
+
+func (w *workbook) sheetPath(name string) (string, error) {
+	if len(w.sheets) == 0 {
+		return "", fmt.Errorf("the workbook has no sheets")
+	}
+
+	sheet := w.sheets[0]
+	if name != "" {
+		found := false
+		for _, s := range w.sheets {
+			if s.Name == name {
+				sheet, found = s, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("the workbook has no sheet called %s", name)
+		}
+	}
+
+	target, ok := w.relationships[sheet.ID]
+	if !ok {
+		return "", fmt.Errorf("not an xlsx file: sheet %s is missing", sheet.Name)
+	}
+	return target, nil
+}
+
+// readSheet returns the cells of a worksheet, with a row for each row up to
+// the last one which has cells. It fails rather than hold more than maxCells.
+func (w *workbook) readSheet(name string) ([][]interface{}, error) {
+	var sheet struct {
+		Rows []struct {
+			Number int        `xml:"r,attr"`
+			Cells  []xlsxCell `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := w.decode(name, &sheet); err != nil {
+		return nil, err
+	}
+
+	var rows [][]interface{}
+	held := 0
+	for i, row := range sheet.Rows {
+		number := row.Number
+		if number == 0 {
+			number = len(rows) + 1
+		}
+		if number > maxXLSXRows {
+			return nil, &ParseError{number, 1, "the worksheet has too many rows"}
+		}
+		if number < len(rows)+1 {
+			return nil, &ParseError{number, 1, fmt.Sprintf("row %d is out of order", i+1)}
+		}
+		for len(rows) < number {
+			rows = append(rows, nil)
+		}
+
+		var cells []interface{}
+		for j, c := range row.Cells {
+			column := j
+			if c.Ref != "" {
+				var err error
+				if column, err = columnIndex(c.Ref); err != nil {
+					return nil, &ParseError{number, j + 1, err.Error()}
+				}
+			}
+			if held+column >= w.maxCells {
+				return nil, &ParseError{number, column + 1, fmt.Sprintf("the worksheet has more than %d cells", w.maxCells)}
+			}
+			for len(cells) <= column {
+				cells = append(cells, nil)
+			}
+
+			value, err := w.cellValue(c)
+			if err != nil {
+				return nil, &ParseError{number, column + 1, err.Error()}
+			}
+			cells[column] = value
+		}
+		rows[number-1] = cells
+		held += len(cells)
+	}
+
+	return rows, nil
+}
+
+func (w *workbook) cellValue(c xlsxCell) (interface{}, error) {
+	switch c.Type {
+	case "s":
+		i, err := strconv.Atoi(c.Value)
+		if err != nil || i < 0 || i >= len(w.sharedStrings) {
+			return nil, fmt.Errorf("%s is not a shared string", c.Value)
+		}
+		return w.sharedStrings[i], nil
+	case "inlineStr":
+		return richText(c.Inline.Text), nil
+	case "str", "d":
+		return c.Value, nil
+	case "b":
+		return c.Value == "1", nil
+	case "e":
+		return nil, fmt.Errorf("the cell contains the error %s", c.Value)
+	}
+
+	if c.Value == "" {
+		return nil, nil
+	}
+
+	if !w.dateStyles[c.Style] {
+		return parseNumber(c.Value)
+	}
+
+	number, err := strconv.ParseFloat(c.Value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a number", c.Value)
+	}
+	return excelTimestamp(number, w.date1904), nil
+}
+
+// timestampColumn converts the numbers in a _timestamp column into
+// timestamps, since they are Excel date serials even when the cells aren't
+// formatted as dates.
+func timestampColumn(rows [][]interface{}, column int, date1904 bool) {
+	for _, row := range rows {
+		if column < len(row) {
+			switch number := row[column].(type) {
+			case int64:
+				row[column] = excelTimestamp(float64(number), date1904)
+			case float64:
+				row[column] = excelTimestamp(number, date1904)
+			}
+		}
+	}
+}
+
+// excelTimestamp converts an Excel date serial, the number of days since the
+// start of 1900 or 1904, into an ISO8601 timestamp. Excel believes that 1900
+// was a leap year, so serials are counted from the end of 1899-12-30 rather
+// than 1899-12-31 for dates after February 1900.
+func excelTimestamp(serial float64, date1904 bool) string {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	switch {
+	case date1904:
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	case serial < 60:
+		epoch = time.Date(1899, 12, 31, 0, 0, 0, 0, time.UTC)
+	}
+
+	days := math.Floor(serial)
+	seconds := math.Floor((serial-days)*86400 + 0.5)
+
+	return epoch.AddDate(0, 0, int(days)).
+		Add(time.Duration(seconds) * time.Second).
+		Format(time.RFC3339)
+}
+
+var (
+	cellRefPattern    = regexp.MustCompile(`^([A-Z]+)[0-9]*$`)
+	quotedTextPattern = regexp.MustCompile(`"[^"]*"|\[[^\]]*\]|\\.`)
+	textTagPattern    = regexp.MustCompile(`(?s)<t(?:\s[^>]*)?>(.*?)</t>`)
+	phoneticPattern   = regexp.MustCompile(`(?s)<rPh(?:\s[^>]*)?>.*?</rPh>`)
+)
+
+// columnIndex returns the zero based column of a cell reference like AB12.
+func columnIndex(ref string) (int, error) {
+	match := cellRefPattern.FindStringSubmatch(ref)
+	if match == nil {
+		return 0, fmt.Errorf("%s is not a cell reference", ref)
+	}
+
+	column := 0
+	for _, letter := range match[1] {
+		column = column*26 + int(letter-'A') + 1
+		if column > maxXLSXColumns {
+			return 0, fmt.Errorf("%s is beyond the last column", ref)
+		}
+	}
+	return column - 1, nil
+}
+
+// richText returns the text of a string item, which may be split into runs
+// with different formatting.
+func richText(inner string) string {
+	var text bytes.Buffer
+	// Phonetic runs are reading aids for the text, not part of it
+	inner = phoneticPattern.ReplaceAllString(inner, "")
+	for _, match := range textTagPattern.FindAllStringSubmatch(inner, -1) {
+		var unescaped string
+		if err := xml.Unmarshal([]byte("<t>"+match[1]+"</t>"), &unescaped); err == nil {
+			text.WriteString(unescaped)
+		}
+	}
+	return text.String()
+}
+
+// isBuiltInDateFormat reports whether one of the number formats that Excel
+// doesn't write into styles.xml is for dates or times.
+func isBuiltInDateFormat(id int) bool {
+	return (id >= 14 && id <= 22) || (id >= 45 && id <= 47)
+}
+
+// isDateFormatCode reports whether a custom number format shows a date or time,
+// ignoring any literal text in it.
+func isDateFormatCode(code string) bool {
+	code = strings.ToLower(quotedTextPattern.ReplaceAllString(code, ""))
+	return strings.ContainsAny(code, "dmyhs")
+}
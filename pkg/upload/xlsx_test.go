@@ -0,0 +1,210 @@
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newWorkbook returns an xlsx file with a sheet for each of sheetData, which
+// are the contents of the <sheetData> elements. Style 1 is a built in date
+// format and style 2 is a custom date format.
+func newWorkbook(date1904 bool, sheetData ...string) []byte {
+	var sheets, rels bytes.Buffer
+	files := map[string]string{
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<si><t>name</t></si><si><r><t>count</t></r><r><rPr><b/></rPr><t>er</t></r></si><si><t>A &amp; B</t></si>` +
+			`<si><t>東京</t><rPh sb="0" eb="2"><t>トウキョウ</t></rPh></si></sst>`,
+		"xl/styles.xml": `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<numFmts><numFmt numFmtId="164" formatCode="dd/mm/yyyy&quot; at &quot;hh:mm"/></numFmts>` +
+			`<cellXfs><xf numFmtId="0"/><xf numFmtId="14"/><xf numFmtId="164"/></cellXfs></styleSheet>`,
+	}
+
+	for i, data := range sheetData {
+		fmt.Fprintf(&sheets, `<sheet name="Sheet%d" sheetId="%d" r:id="rId%d"/>`, i+1, i+1, i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+		files[fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1)] =
+			`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` + data + `</sheetData></worksheet>`
+	}
+
+	files["xl/workbook.xml"] = fmt.Sprintf(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" `+
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`+
+		`<workbookPr date1904="%v"/><sheets>%s</sheets></workbook>`, date1904, sheets.String())
+	files["xl/_rels/workbook.xml.rels"] = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		rels.String() + `</Relationships>`
+
+	var body bytes.Buffer
+	archive := zip.NewWriter(&body)
+	for name, contents := range files {
+		f, err := archive.Create(name)
+		Expect(err).Should(BeNil())
+		f.Write([]byte(contents))
+	}
+	Expect(archive.Close()).Should(BeNil())
+
+	return body.Bytes()
+}
+
+var _ = Describe("XLSX", func() {
+	It("Should use the header row for keys", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>`+
+				`<row r="2"><c r="A2" t="s"><v>2</v></c><c r="B2"><v>3</v></c></row>`+
+				`<row r="4"><c r="A4" t="inlineStr"><is><t>C</t></is></c><c r="B4" t="b"><v>1</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"name": "A & B", "counter": int64(3)},
+			map[string]interface{}{"name": "C", "counter": true}}))
+	})
+
+	It("Should fill in missing cells with nulls", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>a</v></c><c r="B1" t="str"><v>b</v></c><c r="C1" t="str"><v>c</v></c></row>`+
+				`<row r="2"><c r="C2"><v>1</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"a": nil, "b": nil, "c": int64(1)}}))
+	})
+
+	It("Should choose the sheet and header row", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>wrong</v></c></row>`,
+			`<row r="1"><c r="A1" t="str"><v>Title</v></c></row>`+
+				`<row r="3"><c r="A3" t="str"><v>a</v></c></row>`+
+				`<row r="4"><c r="A4"><v>1</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{Sheet: "Sheet2", HeaderRow: 3}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"a": int64(1)}}))
+	})
+
+	It("Should fail when the sheet doesn't exist", func() {
+		_, err := ParseXLSX(newWorkbook(false, ``), XLSXOptions{Sheet: "Missing"}, nil)
+
+		Expect(err).Should(MatchError("the workbook has no sheet called Missing"))
+	})
+
+	It("Should fail when the body isn't a workbook", func() {
+		_, err := ParseXLSX([]byte("name,count"), XLSXOptions{}, nil)
+
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("Should convert dates to timestamps", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>_timestamp</v></c><c r="B1" t="str"><v>date</v></c><c r="C1" t="str"><v>at</v></c></row>`+
+				`<row r="2"><c r="A2"><v>41640</v></c><c r="B2" s="1"><v>41641</v></c><c r="C2" s="2"><v>41640.75</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{
+				"_timestamp": "2014-01-01T00:00:00Z",
+				"date":       "2014-01-02T00:00:00Z",
+				"at":         "2014-01-01T18:00:00Z"}}))
+	})
+
+	It("Should convert dates before March 1900", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>_timestamp</v></c></row>`+
+				`<row r="2"><c r="A2"><v>1</v></c></row>`+
+				`<row r="3"><c r="A3"><v>59</v></c></row>`+
+				`<row r="4"><c r="A4"><v>61</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"_timestamp": "1900-01-01T00:00:00Z"},
+			map[string]interface{}{"_timestamp": "1900-02-28T00:00:00Z"},
+			map[string]interface{}{"_timestamp": "1900-03-01T00:00:00Z"}}))
+	})
+
+	It("Should convert dates in workbooks which count from 1904", func() {
+		body := newWorkbook(true,
+			`<row r="1"><c r="A1" t="str"><v>_timestamp</v></c></row>`+
+				`<row r="2"><c r="A2"><v>40178</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"_timestamp": "2014-01-01T00:00:00Z"}}))
+	})
+
+	It("Should report the row and column of values which don't match the schema", func() {
+		schema := json.RawMessage(`{"properties": {"count": {"type": "integer"}}}`)
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>count</v></c></row>`+
+				`<row r="2"><c r="A2"><v>1.5</v></c></row>`)
+
+		_, err := ParseXLSX(body, XLSXOptions{}, schema)
+
+		Expect(err).Should(Equal(&ParseError{2, 1, "1.5 is not an integer"}))
+	})
+
+	It("Should leave out phonetic readings", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="s"><v>0</v></c></row>`+
+				`<row r="2"><c r="A2" t="s"><v>3</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"name": "東京"}}))
+	})
+
+	It("Should keep the precision of large integers", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>count</v></c></row>`+
+				`<row r="2"><c r="A2"><v>9007199254740993</v></c></row>`)
+
+		records, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(BeNil())
+		Expect(records).Should(Equal([]interface{}{
+			map[string]interface{}{"count": int64(9007199254740993)}}))
+	})
+
+	It("Should fail when a part of the workbook is too large", func() {
+		body := newWorkbook(false, `<row r="1"><c r="A1" t="str"><v>count</v></c></row>`)
+
+		_, err := ParseXLSX(body, XLSXOptions{MaxPartSize: 64}, nil)
+
+		Expect(err).Should(MatchError(ContainSubstring("is larger than the limit of 64 bytes")))
+	})
+
+	It("Should fail when the worksheet holds too many cells", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>count</v></c></row>`+
+				`<row r="2"><c r="XFD2"><v>1</v></c></row>`)
+
+		_, err := ParseXLSX(body, XLSXOptions{MaxCells: 1000}, nil)
+
+		Expect(err).Should(Equal(&ParseError{2, 16384, "the worksheet has more than 1000 cells"}))
+	})
+
+	It("Should report cells containing errors", func() {
+		body := newWorkbook(false,
+			`<row r="1"><c r="A1" t="str"><v>a</v></c><c r="B1" t="str"><v>b</v></c></row>`+
+				`<row r="2"><c r="B2" t="e"><v>#DIV/0!</v></c></row>`)
+
+		_, err := ParseXLSX(body, XLSXOptions{}, nil)
+
+		Expect(err).Should(Equal(&ParseError{2, 2, "the cell contains the error #DIV/0!"}))
+	})
+})
@@ -1,11 +1,18 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
+// Unmarshal decodes JSON into result, which must be a pointer. Unlike
+// json.Unmarshal, numbers decoded into interface{} values keep their
+// precision: integers become int64s and other numbers become float64s.
 func Unmarshal(res []byte, result interface{}) error {
 	switch kind := reflect.TypeOf(result).Kind(); kind {
 	case reflect.Ptr:
@@ -13,11 +20,81 @@ func Unmarshal(res []byte, result interface{}) error {
 		return fmt.Errorf("parameter result should be a pointer, but is %v", kind)
 	}
 
-	err := json.Unmarshal(res, result)
+	decoder := json.NewDecoder(bytes.NewReader(res))
+	decoder.UseNumber()
 
-	if err != nil {
+	if err := decoder.Decode(result); err != nil {
 		return err
 	}
 
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+
+	convertNumbers(reflect.ValueOf(result).Elem())
+
 	return nil
 }
+
+// ParseNumber returns an int64 if s is an integer which fits in one,
+// otherwise a float64.
+func ParseNumber(s string) (interface{}, error) {
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+// convertNumbers replaces the json.Numbers in the interface{} values held by v
+// with int64s and float64s.
+func convertNumbers(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if number, ok := v.Interface().(json.Number); ok {
+			if converted, err := ParseNumber(number.String()); err == nil && v.CanSet() {
+				v.Set(reflect.ValueOf(converted))
+			}
+			return
+		}
+		if elem := v.Elem(); elem.Kind() == reflect.Map || elem.Kind() == reflect.Slice {
+			convertNumbers(elem)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := v.MapIndex(key)
+			if value.Kind() != reflect.Interface {
+				convertNumbers(value)
+				continue
+			}
+			if number, ok := value.Interface().(json.Number); ok {
+				if converted, err := ParseNumber(number.String()); err == nil {
+					v.SetMapIndex(key, reflect.ValueOf(converted))
+				}
+				continue
+			}
+			if !value.IsNil() {
+				convertNumbers(value.Elem())
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			convertNumbers(v.Index(i))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			convertNumbers(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				convertNumbers(v.Field(i))
+			}
+		}
+	}
+}
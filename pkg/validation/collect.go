@@ -43,7 +43,7 @@ func (x *collectValidator) Validate(args map[string][]string) (res interface{},
 			}
 		}
 
-		if !IsValidKey(key) {
+		if !IsValidPath(key) {
 			return nil, fmt.Errorf("collect isn't a valid key <%v>", key)
 		}
 
@@ -33,7 +33,7 @@ func isValidFilterBy(candidate string) bool {
 		return false
 	}
 
-	if !IsValidKey(strings.Split(candidate, ":")[0]) {
+	if !IsValidPath(strings.Split(candidate, ":")[0]) {
 		return false
 	}
 
@@ -23,7 +23,7 @@ func (x *groupByValidator) Validate(args map[string][]string) (res interface{},
 		return nil, fmt.Errorf("Can only have a single value for <group_by>")
 	}
 
-	if !IsValidKey(values[0]) {
+	if !IsValidPath(values[0]) {
 		return nil, fmt.Errorf("Cannot group by an invalid field name")
 	}
 
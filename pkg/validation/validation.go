@@ -2,6 +2,7 @@ package validation
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -85,10 +86,13 @@ func IsValidID(v interface{}) bool {
 	}
 }
 
-// IsValidValue returns true if the value is one that we handle and store, otherwise false.
-func IsValidValue(v interface{}) bool {
+// MaxDepth is how deeply objects and arrays can be nested in a record.
+var MaxDepth = 5
+
+// IsValidScalar returns true if the value is a single value that we handle and store, otherwise false.
+func IsValidScalar(v interface{}) bool {
 	switch v.(type) {
-	case int64, float64, string, time.Time:
+	case int64, float64, bool, string, time.Time:
 		{
 			return true
 		}
@@ -96,3 +100,79 @@ func IsValidValue(v interface{}) bool {
 		return v == nil
 	}
 }
+
+// The reasons that CheckValue can give for a value being invalid.
+const (
+	InvalidScalar = iota
+	InvalidKey
+	InternalKey
+	NestedTooDeep
+)
+
+// ValueProblem describes why a value isn't one that we handle and store.
+// Path is the keys and array indexes leading from the value to the problem.
+type ValueProblem struct {
+	Path   []string
+	Reason int
+}
+
+// IsValidValue returns true if the value is one that we handle and store, otherwise false.
+// Objects and arrays are valid if they are nested no more than MaxDepth deep and all
+// of their keys and values are valid.
+func IsValidValue(v interface{}) bool {
+	return CheckValue(v) == nil
+}
+
+// CheckValue returns the first problem it finds with a value, or nil if it is
+// one that we handle and store.
+func CheckValue(v interface{}) *ValueProblem {
+	return checkValue(v, nil, 0)
+}
+
+func checkValue(v interface{}, path []string, depth int) *ValueProblem {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if depth >= MaxDepth {
+			return &ValueProblem{path, NestedTooDeep}
+		}
+		for k, nested := range value {
+			keyPath := append(path[:len(path):len(path)], k)
+			if !IsValidKey(k) {
+				return &ValueProblem{keyPath, InvalidKey}
+			}
+			if IsInternalKey(k) {
+				return &ValueProblem{keyPath, InternalKey}
+			}
+			if problem := checkValue(nested, keyPath, depth+1); problem != nil {
+				return problem
+			}
+		}
+		return nil
+	case []interface{}:
+		if depth >= MaxDepth {
+			return &ValueProblem{path, NestedTooDeep}
+		}
+		for i, nested := range value {
+			if problem := checkValue(nested, append(path[:len(path):len(path)], strconv.Itoa(i)), depth+1); problem != nil {
+				return problem
+			}
+		}
+		return nil
+	default:
+		if !IsValidScalar(v) {
+			return &ValueProblem{path, InvalidScalar}
+		}
+		return nil
+	}
+}
+
+// IsValidPath returns true if the string is a valid key, or valid keys separated
+// by dots to refer to a field of a nested object, otherwise false.
+func IsValidPath(path string) bool {
+	for _, key := range strings.Split(path, ".") {
+		if !IsValidKey(key) {
+			return false
+		}
+	}
+	return true
+}
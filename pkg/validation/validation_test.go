@@ -6,6 +6,7 @@ import (
 	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Testing with Ginkgo", func() {
@@ -91,6 +92,18 @@ var _ = Describe("Testing with Ginkgo", func() {
 		args["filter_by"] = []string{"$foo:bar"}
 		expectError(expectation{t: GinkgoT(), args: args})
 	})
+	It("filter by a dotted path is okay", func() {
+
+		args := make(map[string][]string)
+		args["filter_by"] = []string{"device.os:android"}
+		expectSuccess(expectation{t: GinkgoT(), args: args})
+	})
+	It("filter by a dotted path with an empty key fails", func() {
+
+		args := make(map[string][]string)
+		args["filter_by"] = []string{"device..os:android"}
+		expectError(expectation{t: GinkgoT(), args: args})
+	})
 	It("sort by ascending is okay", func() {
 
 		args := make(map[string][]string)
@@ -139,6 +152,18 @@ var _ = Describe("Testing with Ginkgo", func() {
 		args["group_by"] = []string{"with-hyphen"}
 		expectError(expectation{t: GinkgoT(), args: args})
 	})
+	It("group by a dotted path is okay", func() {
+
+		args := make(map[string][]string)
+		args["group_by"] = []string{"device.os"}
+		expectSuccess(expectation{t: GinkgoT(), args: args})
+	})
+	It("group by a dotted path with an invalid key fails", func() {
+
+		args := make(map[string][]string)
+		args["group_by"] = []string{"device.with-hyphen"}
+		expectError(expectation{t: GinkgoT(), args: args})
+	})
 	It("sort by with period only fails", func() {
 
 		args := make(map[string][]string)
@@ -178,6 +203,13 @@ var _ = Describe("Testing with Ginkgo", func() {
 		args["group_by"] = []string{"foo"}
 		expectSuccess(expectation{t: GinkgoT(), args: args})
 	})
+	It("collect a dotted path is okay", func() {
+
+		args := make(map[string][]string)
+		args["collect"] = []string{"device.version:set"}
+		args["group_by"] = []string{"device.os"}
+		expectSuccess(expectation{t: GinkgoT(), args: args})
+	})
 	It("collect with function fails", func() {
 
 		args := make(map[string][]string)
@@ -407,3 +439,39 @@ func expectSuccess(e expectation) {
 		e.t.Errorf("%v should have been okay but was %v", e.args, err)
 	}
 }
+
+var _ = Describe("Values", func() {
+	It("allows scalars", func() {
+		for _, v := range []interface{}{int64(1), 1.5, true, "a", time.Now(), nil} {
+			Expect(IsValidValue(v)).Should(BeTrue())
+		}
+	})
+
+	It("allows nested objects and arrays with valid keys", func() {
+		Expect(IsValidValue(map[string]interface{}{
+			"os":       "android",
+			"versions": []interface{}{"4.4", map[string]interface{}{"major": 5.0}}})).Should(BeTrue())
+	})
+
+	It("does not allow invalid or internal keys in nested objects", func() {
+		Expect(IsValidValue(map[string]interface{}{"with-hyphen": "a"})).Should(BeFalse())
+		Expect(IsValidValue(map[string]interface{}{"_id": "a"})).Should(BeFalse())
+	})
+
+	It("does not allow values nested more than MaxDepth deep", func() {
+		var v interface{} = "a"
+		for i := 0; i < MaxDepth; i++ {
+			v = []interface{}{v}
+		}
+		Expect(IsValidValue(v)).Should(BeTrue())
+		Expect(IsValidValue([]interface{}{v})).Should(BeFalse())
+	})
+
+	It("reports where the problem with a value is", func() {
+		Expect(CheckValue("a")).Should(BeNil())
+		Expect(CheckValue(map[string]interface{}{"versions": []interface{}{"4.4", struct{}{}}})).Should(Equal(
+			&ValueProblem{[]string{"versions", "1"}, InvalidScalar}))
+		Expect(CheckValue([]interface{}{map[string]interface{}{"_id": "a"}})).Should(Equal(
+			&ValueProblem{[]string{"0", "_id"}, InternalKey}))
+	})
+})